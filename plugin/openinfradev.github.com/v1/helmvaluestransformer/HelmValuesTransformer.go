@@ -4,19 +4,33 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
 
 	"github.com/pkg/errors"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	"k8s.io/kube-openapi/pkg/validation/strfmt"
+	"k8s.io/kube-openapi/pkg/validation/validate"
+	"sigs.k8s.io/kustomize/api/filters/patchjson6902"
 	"sigs.k8s.io/kustomize/api/filters/patchstrategicmerge"
 	"sigs.k8s.io/kustomize/api/resmap"
 	"sigs.k8s.io/kustomize/api/resource"
-	"sigs.k8s.io/kustomize/kyaml/filtersutil"
 	"sigs.k8s.io/kustomize/kyaml/resid"
+	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
 	"sigs.k8s.io/yaml"
 )
 
@@ -25,14 +39,249 @@ type plugin struct {
 	h      *resmap.PluginHelpers
 	Global map[string]interface{} `json:"global,omitempty" yaml:"global,omitempty"`
 	Charts []ReplacedChart        `json:"charts,omitempty" yaml:"charts,omitempty"`
-	Logger *log.Logger
+	// AllowEmpty makes the config without charts a no-op instead of an error
+	AllowEmpty bool `json:"allowEmpty,omitempty" yaml:"allowEmpty,omitempty"`
+	// GlobalsFrom are yaml files of global variables merged underneath global in order
+	GlobalsFrom []GlobalsFile `json:"globalsFrom,omitempty" yaml:"globalsFrom,omitempty"`
+	// GlobalProfiles are the named sets of global variables, and the one of ActiveProfile is merged over global
+	GlobalProfiles map[string]map[string]interface{} `json:"globalProfiles,omitempty" yaml:"globalProfiles,omitempty"`
+	// ActiveProfile is the name of the profile in GlobalProfiles, or $(NAME) to read it from the environment variable
+	ActiveProfile string `json:"activeProfile,omitempty" yaml:"activeProfile,omitempty"`
+	// ChartsFromEnv is the environment variable of the comma-separated names of the charts to transform,
+	// and the other charts are skipped. All the charts are transformed if it is not set or empty.
+	ChartsFromEnv string `json:"chartsFromEnv,omitempty" yaml:"chartsFromEnv,omitempty"`
+	// VersionMap is the chart version of each HelmRelease name used if the chart has no chartVersion
+	VersionMap map[string]string `json:"versionMap,omitempty" yaml:"versionMap,omitempty"`
+	// CommonOverride is merged underneath override of every chart
+	CommonOverride Override `json:"commonOverride,omitempty" yaml:"commonOverride,omitempty"`
+	// TargetGvk is the kind of resource to override instead of HelmRelease
+	TargetGvk *resid.Gvk `json:"targetGvk,omitempty" yaml:"targetGvk,omitempty"`
+	// Strict makes a chart without HelmRelease an error instead of skipping it
+	Strict bool `json:"strict,omitempty" yaml:"strict,omitempty"`
+	// LogLevel is one of trace, debug, info, warn and silent (default info)
+	LogLevel string `json:"logLevel,omitempty" yaml:"logLevel,omitempty"`
+	// LogFormat is text or json writing each log as a json line (default text)
+	LogFormat string `json:"logFormat,omitempty" yaml:"logFormat,omitempty"`
+	// Report writes what is applied to each chart to ReportPath, or stderr if it is empty
+	Report     bool   `json:"report,omitempty" yaml:"report,omitempty"`
+	ReportPath string `json:"reportPath,omitempty" yaml:"reportPath,omitempty"`
+	// DryRun logs the diff of each HelmRelease instead of patching it
+	DryRun bool `json:"dryRun,omitempty" yaml:"dryRun,omitempty"`
+	// MergeValues deep-merges override into spec.values instead of patching it
+	MergeValues bool `json:"mergeValues,omitempty" yaml:"mergeValues,omitempty"`
+	// AllowEnvGlobals falls back to the environment variables for undefined global variables
+	AllowEnvGlobals bool `json:"allowEnvGlobals,omitempty" yaml:"allowEnvGlobals,omitempty"`
+	// MergeDuplicates deep-merges override of the charts with the same name instead of failing
+	MergeDuplicates bool `json:"mergeDuplicates,omitempty" yaml:"mergeDuplicates,omitempty"`
+	// DumpValuesDir is a directory to write the values of each HelmRelease to <name>.yaml
+	DumpValuesDir string `json:"dumpValuesDir,omitempty" yaml:"dumpValuesDir,omitempty"`
+	// WarnNoop logs a warning for the override paths which do not change the value
+	WarnNoop bool `json:"warnNoop,omitempty" yaml:"warnNoop,omitempty"`
+	// ValuesPath is the path of values to override in the resource (default spec.values)
+	ValuesPath string `json:"valuesPath,omitempty" yaml:"valuesPath,omitempty"`
+	// EmptyAsDefault falls back to the default of $(name:-default) for the global variable of an empty string as well
+	EmptyAsDefault bool `json:"emptyAsDefault,omitempty" yaml:"emptyAsDefault,omitempty"`
+	// OnUndefinedGlobal is one of error, keep and empty (default error)
+	OnUndefinedGlobal string `json:"onUndefinedGlobal,omitempty" yaml:"onUndefinedGlobal,omitempty"`
+	// MaxPathDepth is the maximum number of segments of an override path (default 64)
+	MaxPathDepth int `json:"maxPathDepth,omitempty" yaml:"maxPathDepth,omitempty"`
+	// VerifyIdempotent patches each HelmRelease again and fails if the result differs
+	VerifyIdempotent bool `json:"verifyIdempotent,omitempty" yaml:"verifyIdempotent,omitempty"`
+	// ErrorMode is failFast returning the first error of charts, or collect returning all of them (default failFast)
+	ErrorMode string `json:"errorMode,omitempty" yaml:"errorMode,omitempty"`
+	// ValidateOnly validates the charts by patching a stub HelmRelease of each in Config, and leaves the resources untouched
+	ValidateOnly bool `json:"validateOnly,omitempty" yaml:"validateOnly,omitempty"`
+	// OutputChangedOnly removes the resources which are not changed by any chart from the output for debugging
+	OutputChangedOnly bool `json:"outputChangedOnly,omitempty" yaml:"outputChangedOnly,omitempty"`
+	// StrictConfig makes an unknown field in the config an error instead of ignoring it
+	StrictConfig bool `json:"strictConfig,omitempty" yaml:"strictConfig,omitempty"`
+	// SourceRefPattern is a regular expression which sourceRef of charts must match as kind/namespace/name
+	SourceRefPattern string `json:"sourceRefPattern,omitempty" yaml:"sourceRefPattern,omitempty"`
+	// SkipKey is the annotation or label "true" of which makes the HelmRelease skipped (default transformer.openinfradev/skip)
+	SkipKey string `json:"skipKey,omitempty" yaml:"skipKey,omitempty"`
+	Logger  *leveledLogger
+
+	// substitutions is the count of global variables substituted
+	substitutions int
+	// stats are the counts of the last Transform
+	stats TransformStats
+	// changed are the resources changed by charts, which are tracked with outputChangedOnly
+	changed map[*resource.Resource]bool
+	// lists are the List resources of the HelmReleases nested in them
+	lists map[*resource.Resource]*resource.Resource
+	// sourceRefRe is SourceRefPattern compiled
+	sourceRefRe *regexp.Regexp
+	// activeCharts are the names of the charts in ChartsFromEnv, or nil for all the charts
+	activeCharts map[string]bool
 }
 
 // ReplacedChart is including target information and chart values to override
 type ReplacedChart struct {
-	Name     string                 `json:"name,omitempty" yaml:"name,omitempty"`
-	Source   ChartSource            `json:"source,omitempty" yaml:"source,omitempty"`
-	Override map[string]interface{} `json:"override,omitempty" yaml:"override,omitempty"`
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// Names applies the chart to each of HelmReleases named in it instead of name
+	Names []string `json:"names,omitempty" yaml:"names,omitempty"`
+	// NameRegex matches name as a regular expression against the names of HelmReleases
+	NameRegex bool `json:"nameRegex,omitempty" yaml:"nameRegex,omitempty"`
+	// Namespace matches only the HelmReleases in the namespace
+	Namespace string      `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	Source    ChartSource `json:"source,omitempty" yaml:"source,omitempty"`
+	// ChartVersion replaces the chart version only, which wins over the version of source
+	ChartVersion string `json:"chartVersion,omitempty" yaml:"chartVersion,omitempty"`
+	// SourceRef replaces spec.chart.spec.sourceRef of Flux v2, which wins over repository and type of source
+	SourceRef *SourceRef `json:"sourceRef,omitempty" yaml:"sourceRef,omitempty"`
+	Override  Override   `json:"override,omitempty" yaml:"override,omitempty"`
+	// ReleaseName replaces spec.releaseName of HelmRelease
+	ReleaseName string `json:"releaseName,omitempty" yaml:"releaseName,omitempty"`
+	// TargetNamespace replaces spec.targetNamespace of HelmRelease
+	TargetNamespace string `json:"targetNamespace,omitempty" yaml:"targetNamespace,omitempty"`
+	// Interval replaces spec.interval of HelmRelease, i.e. 5m
+	Interval string `json:"interval,omitempty" yaml:"interval,omitempty"`
+	// Retries is an integer or a global variable of it replacing spec.install.remediation.retries of HelmRelease
+	Retries interface{} `json:"retries,omitempty" yaml:"retries,omitempty"`
+	// PatchStrategy is how override is applied to HelmRelease, one of merge, strategic and json
+	// (default merge with mergeValues, or strategic)
+	PatchStrategy string `json:"patchStrategy,omitempty" yaml:"patchStrategy,omitempty"`
+	// GoTemplate renders the strings in override as Go templates with the global variables before replacing them
+	GoTemplate bool `json:"goTemplate,omitempty" yaml:"goTemplate,omitempty"`
+	// Delete are the paths removed from spec.values of HelmRelease before override
+	Delete []string `json:"delete,omitempty" yaml:"delete,omitempty"`
+	// ValuesFrom are appended to spec.valuesFrom of HelmRelease
+	ValuesFrom []ValuesReference `json:"valuesFrom,omitempty" yaml:"valuesFrom,omitempty"`
+	// ValuesSchema is a path to JSON schema file which the override values must match
+	ValuesSchema string `json:"valuesSchema,omitempty" yaml:"valuesSchema,omitempty"`
+	// Enabled is a bool or a global variable of it, and the chart is skipped if it is false (default true)
+	Enabled interface{} `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	// RawValues passes override and source through verbatim without replacing global variables
+	RawValues bool `json:"rawValues,omitempty" yaml:"rawValues,omitempty"`
+	// ForEach are the global variables of each copy of the chart, and name of the copy can have them, i.e. app-$(region)
+	ForEach []map[string]interface{} `json:"forEach,omitempty" yaml:"forEach,omitempty"`
+	// DependsOn are the names of charts transformed before this chart
+	DependsOn []string `json:"dependsOn,omitempty" yaml:"dependsOn,omitempty"`
+	// Globals shadow the global variables for this chart only
+	Globals map[string]interface{} `json:"globals,omitempty" yaml:"globals,omitempty"`
+}
+
+// Override is the values to override by inline path.
+// It is either a mapping or a list of mappings which are deep-merged in order, and the later one wins.
+type Override map[string]interface{}
+
+func (o *Override) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] != '[' {
+		return json.Unmarshal(data, (*map[string]interface{})(o))
+	}
+
+	var overrides []map[string]interface{}
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return err
+	}
+	merged := Override{}
+	for _, override := range overrides {
+		mergeValues(merged, override)
+	}
+	*o = merged
+	return nil
+}
+
+// GlobalsFile is a yaml file of global variables given as a path or a mapping of path and prefix
+type GlobalsFile struct {
+	Path string `json:"path,omitempty" yaml:"path,omitempty"`
+	// Prefix exposes the global variables of the file as $(prefix.name)
+	Prefix string `json:"prefix,omitempty" yaml:"prefix,omitempty"`
+}
+
+func (f *GlobalsFile) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '"' {
+		return json.Unmarshal(data, &f.Path)
+	}
+	type globalsFile GlobalsFile
+	return json.Unmarshal(data, (*globalsFile)(f))
+}
+
+// The classes of errors returned by Transform, which are matched with errors.Is
+var (
+	// ErrMissingRelease is returned in strict mode if no HelmRelease is found for a chart
+	ErrMissingRelease = errors.New("missing HelmRelease")
+	// ErrUndefinedGlobal is returned if a global variable is not defined
+	ErrUndefinedGlobal = errors.New("undefined global variable")
+	// ErrPatchFailed is returned if the override can not be patched to a HelmRelease
+	ErrPatchFailed = errors.New("patch failed")
+)
+
+// classifiedError is err matching class with errors.Is while keeping the message of err
+type classifiedError struct {
+	err   error
+	class error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+func (e *classifiedError) Is(target error) bool {
+	return target == e.class
+}
+
+// globalVarRef is a reference to global variable in chart
+type globalVarRef struct {
+	name  string
+	chart string
+	path  string
+}
+
+// undefinedGlobalVarError lists the references to global variables which are not defined
+type undefinedGlobalVarError struct {
+	refs []globalVarRef
+}
+
+func (e *undefinedGlobalVarError) Error() string {
+	refs := make([]string, 0, len(e.refs))
+	for _, ref := range e.refs {
+		str := "$(" + ref.name + ")"
+		if ref.chart != "" {
+			str += " in chart " + ref.chart + " at " + ref.path
+		}
+		refs = append(refs, str)
+	}
+	sort.Strings(refs)
+	if len(refs) == 1 {
+		return "Can not found global variable named " + refs[0]
+	}
+	return "Can not found global variables named " + strings.Join(refs, ", ")
+}
+
+func (e *undefinedGlobalVarError) Is(target error) bool {
+	return target == ErrUndefinedGlobal
+}
+
+// collect appends the references of err to e with chart and path which are not set yet.
+// err is returned as it is if it is not undefinedGlobalVarError.
+func (e *undefinedGlobalVarError) collect(err error, chart, path string) error {
+	undefinedErr, ok := err.(*undefinedGlobalVarError)
+	if !ok {
+		return err
+	}
+	for _, ref := range undefinedErr.refs {
+		if ref.chart == "" {
+			ref.chart = chart
+		}
+		if ref.path == "" {
+			ref.path = path
+		}
+		e.refs = append(e.refs, ref)
+	}
+	return nil
+}
+
+// orNil returns nil if e has no reference
+func (e *undefinedGlobalVarError) orNil() error {
+	if len(e.refs) == 0 {
+		return nil
+	}
+	return e
 }
 
 // ChartSource defines the source of helm chart
@@ -43,209 +292,3540 @@ type ChartSource struct {
 	Type       string `json:"type,omitempty" yaml:"type,omitempty"`
 }
 
+// SourceRef is the source of chart in Flux v2, i.e. HelmRepository
+type SourceRef struct {
+	Kind      string `json:"kind,omitempty" yaml:"kind,omitempty"`
+	Name      string `json:"name,omitempty" yaml:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+}
+
+// ValuesReference is a ConfigMap or Secret which HelmRelease pulls the values from
+type ValuesReference struct {
+	Kind      string `json:"kind,omitempty" yaml:"kind,omitempty"`
+	Name      string `json:"name,omitempty" yaml:"name,omitempty"`
+	ValuesKey string `json:"valuesKey,omitempty" yaml:"valuesKey,omitempty"`
+	Optional  bool   `json:"optional,omitempty" yaml:"optional,omitempty"`
+}
+
+// logLevel is a verbosity of leveledLogger
+type logLevel int
+
+const (
+	levelTrace logLevel = iota
+	levelDebug
+	levelInfo
+	levelWarn
+	levelSilent
+)
+
+var logLevels = map[string]logLevel{
+	"trace":  levelTrace,
+	"debug":  levelDebug,
+	"info":   levelInfo,
+	"warn":   levelWarn,
+	"silent": levelSilent,
+}
+
+var logLevelNames = [...]string{"trace", "debug", "info", "warn", "silent"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// leveledLogger writes only the logs at or above its level
+type leveledLogger struct {
+	level  logLevel
+	logger *log.Logger
+	// json writes each log as a line of logEntry to out instead of the text of logger
+	json bool
+	out  io.Writer
+	// chart and path are the fields of logEntry
+	chart, path string
+}
+
+// logEntry is a log line of the json format
+type logEntry struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	Chart   string `json:"chart,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Caller  string `json:"caller"`
+}
+
+// newLeveledLogger returns a logger writing to out at level in format, which are info and text if empty
+func newLeveledLogger(level, format string, out io.Writer) (*leveledLogger, error) {
+	if level == "" {
+		level = "info"
+	}
+	l, ok := logLevels[level]
+	if !ok {
+		return nil, errors.New("unknown logLevel " + level)
+	}
+	if format != "" && format != logFormatText && format != logFormatJSON {
+		return nil, errors.New("unknown logFormat " + format)
+	}
+	return &leveledLogger{level: l, logger: log.New(out, "", log.Lshortfile), json: format == logFormatJSON, out: out}, nil
+}
+
+// with returns a copy of the logger adding chart and path to the logs in the json format
+func (l *leveledLogger) with(chart, path string) *leveledLogger {
+	c := *l
+	c.chart, c.path = chart, path
+	return &c
+}
+
+func (l *leveledLogger) logf(level logLevel, format string, v ...interface{}) {
+	if level < l.level {
+		return
+	}
+	msg := fmt.Sprintf(format, v...)
+	if !l.json {
+		// skip logf and the leveled method to report the caller
+		_ = l.logger.Output(3, "["+strings.ToUpper(level.String())+"] "+msg)
+		return
+	}
+	entry := logEntry{Level: level.String(), Message: msg, Chart: l.chart, Path: l.path}
+	if _, file, line, ok := runtime.Caller(2); ok {
+		entry.Caller = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	_, _ = l.out.Write(append(b, '\n'))
+}
+
+func (l *leveledLogger) Tracef(format string, v ...interface{}) {
+	l.logf(levelTrace, format, v...)
+}
+
+func (l *leveledLogger) Debugf(format string, v ...interface{}) {
+	l.logf(levelDebug, format, v...)
+}
+
+func (l *leveledLogger) Infof(format string, v ...interface{}) {
+	l.logf(levelInfo, format, v...)
+}
+
+func (l *leveledLogger) Warnf(format string, v ...interface{}) {
+	l.logf(levelWarn, format, v...)
+}
+
 // nolint: golint
 // noinspection GoUnusedGlobalVariable
 var KustomizePlugin plugin
 
+// deleteDirective is an override value removing the key or the list item at the path
+const deleteDirective = "$delete"
+
+// wildcardSegment of an override path, i.e. "containers.*.imagePullPolicy", matches each child
+// of the mapping or the list at the path in the values
+const wildcardSegment = "*"
+
+// setIfAbsentSuffix of an override path, i.e. "replicas?", skips the path if the values have a non-null value at it
+const setIfAbsentSuffix = "?"
+
+// onUndefinedGlobal options
+const (
+	// undefinedGlobalError makes an undefined global variable an error
+	undefinedGlobalError = "error"
+	// undefinedGlobalKeep leaves an undefined global variable as it is
+	undefinedGlobalKeep = "keep"
+	// undefinedGlobalEmpty replaces an undefined global variable with an empty string
+	undefinedGlobalEmpty = "empty"
+)
+
+// defaultSkipKey is the annotation or label opting a HelmRelease out of the transformer
+const defaultSkipKey = "transformer.openinfradev/skip"
+
+// The implicit global variables of HelmRelease
+const (
+	// chartNameVar is the name of HelmRelease
+	chartNameVar = "chartName"
+	// releaseNameVar is the name of HelmRelease as well
+	releaseNameVar = "releaseName"
+	// releaseNamespaceVar is the namespace of HelmRelease
+	releaseNamespaceVar = "releaseNamespace"
+)
+
+// rootPathPrefix starts an override path from the root of resource instead of the values, i.e. "/metadata.labels.team"
+const rootPathPrefix = "/"
+
+// The values of patchStrategy
+const (
+	// patchStrategyMerge deep-merges override into the values like mergeValues
+	patchStrategyMerge = "merge"
+	// patchStrategyStrategic applies override as a strategic merge patch
+	patchStrategyStrategic = "strategic"
+	// patchStrategyJSON applies override as RFC6902 operations replacing the lists as a whole
+	patchStrategyJSON = "json"
+)
+
+// The values of errorMode
+const (
+	// errorModeFailFast returns the first error of charts
+	errorModeFailFast = "failFast"
+	// errorModeCollect patches the other charts and returns the errors of charts together
+	errorModeCollect = "collect"
+)
+
+// chartRefPrefix starts a global variable referring to the override of another chart, i.e. "$(@api.ingress.host)"
+const chartRefPrefix = "@"
+
+// replaceDirective is an override key whose value replaces the whole spec.values
+const replaceDirective = "$replace"
+
+// refDirective is the key of override value copying the value of the other override path
+const refDirective = "$ref"
+
+// fileDirective and fileYamlDirective are the keys of override value loading a file as a string and as yaml
+const (
+	fileDirective     = "$file"
+	fileYamlDirective = "$fileYaml"
+)
+
+// patchDirective is the directive key of strategic merge patch
+const patchDirective = "$patch"
+
+// appendSegment is the path segment of "[]" suffix appending to the list, i.e. "extraEnv[]"
+const appendSegment = "[]"
+
+// deletion marks the path to remove while creating the patch
+type deletion struct{}
+
+// escapedVarPrefix is a placeholder of escaped "$$(" while replacing global variables
+const escapedVarPrefix = "\ufffe("
+
+// helmReleaseGvks are the HelmRelease kinds looked up in order until one matches.
+// Flux v1(helm-operator) comes first for backward compatibility.
+var helmReleaseGvks = []resid.Gvk{
+	{Group: "helm.fluxcd.io", Version: "v1", Kind: "HelmRelease"},
+	{Group: "helm.toolkit.fluxcd.io", Version: "v2beta1", Kind: "HelmRelease"},
+	{Group: "helm.toolkit.fluxcd.io", Version: "v2beta2", Kind: "HelmRelease"},
+	{Group: "helm.toolkit.fluxcd.io", Version: "v2", Kind: "HelmRelease"},
+}
+
+// sourceRefKinds maps the chart source type used by Flux v1 to the kind of Flux v2 source
+var sourceRefKinds = map[string]string{
+	"helmrepo": "HelmRepository",
+	"git":      "GitRepository",
+	"bucket":   "Bucket",
+}
+
 func (p *plugin) Config(
 	h *resmap.PluginHelpers, c []byte) (err error) {
 	p.h = h
 	p.Global = nil
 	p.Charts = nil
+	p.AllowEmpty = false
+	p.GlobalsFrom = nil
+	p.GlobalProfiles = nil
+	p.ActiveProfile = ""
+	p.ChartsFromEnv = ""
+	p.activeCharts = nil
+	p.VersionMap = nil
+	p.CommonOverride = nil
+	p.TargetGvk = nil
+	p.Strict = false
+	p.LogLevel = ""
+	p.LogFormat = ""
+	p.Report = false
+	p.ReportPath = ""
+	p.DryRun = false
+	p.MergeValues = false
+	p.MergeDuplicates = false
+	p.AllowEnvGlobals = false
+	p.OnUndefinedGlobal = ""
+	p.EmptyAsDefault = false
+	p.ValuesPath = ""
+	p.WarnNoop = false
+	p.DumpValuesDir = ""
+	p.MaxPathDepth = 0
+	p.StrictConfig = false
+	p.SourceRefPattern = ""
+	p.sourceRefRe = nil
+	p.SkipKey = ""
+	p.ErrorMode = ""
+	p.VerifyIdempotent = false
+	p.OutputChangedOnly = false
+	p.ValidateOnly = false
 
+	c = normalizeText(c)
+	if c, err = unwrapConfigMap(c); err != nil {
+		return errors.Wrap(err, "invalid config")
+	}
 	err = yaml.Unmarshal(c, p)
 	if err != nil {
-		return nil
+		return errors.Wrap(err, "invalid config")
 	}
-	if p.Charts == nil {
+	if p.StrictConfig {
+		if err = checkConfigFields(c); err != nil {
+			return errors.Wrap(err, "invalid config")
+		}
+	}
+	if p.Charts == nil && !p.AllowEmpty {
 		return errors.New("helmValues is not expected to be nil")
 	}
-	p.Logger = log.New(os.Stdout, "[DEBUG] ", log.Lshortfile)
+	p.Logger, err = newLeveledLogger(p.LogLevel, p.LogFormat, os.Stderr)
+	if err != nil {
+		return err
+	}
+	if err = p.loadGlobalsFrom(); err != nil {
+		return err
+	}
+	if err = p.applyGlobalProfile(); err != nil {
+		return err
+	}
+	if err = p.expandChartNames(); err != nil {
+		return err
+	}
+	if err = p.expandForEach(); err != nil {
+		return err
+	}
+	if err = p.checkDuplicateCharts(); err != nil {
+		return err
+	}
+	p.loadActiveCharts()
+	for _, chart := range p.Charts {
+		switch chart.PatchStrategy {
+		case "", patchStrategyMerge, patchStrategyStrategic, patchStrategyJSON:
+		default:
+			return fmt.Errorf("unknown patchStrategy %s of chart %s", chart.PatchStrategy, chart.Name)
+		}
+	}
+	if p.TargetGvk != nil && p.TargetGvk.Kind == "" {
+		return errors.New("kind of targetGvk is not expected to be empty")
+	}
+	if p.ValuesPath != "" {
+		paths, err := splitOverridePath(p.ValuesPath)
+		if err != nil {
+			return errors.Wrap(err, "invalid valuesPath")
+		}
+		if containsString(paths, "") {
+			return errors.New("invalid valuesPath " + p.ValuesPath)
+		}
+	}
+	if p.SourceRefPattern != "" {
+		if p.sourceRefRe, err = regexp.Compile(p.SourceRefPattern); err != nil {
+			return errors.Wrap(err, "invalid sourceRefPattern")
+		}
+	}
+	if p.MaxPathDepth < 0 {
+		return fmt.Errorf("invalid maxPathDepth %d", p.MaxPathDepth)
+	}
+	if p.ErrorMode != "" && p.ErrorMode != errorModeFailFast && p.ErrorMode != errorModeCollect {
+		return errors.New("unknown errorMode " + p.ErrorMode)
+	}
+	switch p.OnUndefinedGlobal {
+	case "", undefinedGlobalError, undefinedGlobalKeep, undefinedGlobalEmpty:
+	default:
+		return errors.New("unknown onUndefinedGlobal " + p.OnUndefinedGlobal)
+	}
+	if p.ValidateOnly {
+		return p.validate()
+	}
 	return nil
 }
 
-func (p *plugin) Transform(m resmap.ResMap) (err error) {
+// validate patches a stub HelmRelease named after each enabled chart without logs, which checks
+// the global variables, the paths and the values of the charts without the resources.
+// The errors of all charts are returned together.
+func (p *plugin) validate() error {
+	if _, err := p.sortCharts(); err != nil {
+		return err
+	}
+	logger := p.Logger
+	defer func() {
+		p.Logger = logger
+	}()
+	p.Logger, _ = newLeveledLogger("silent", "", io.Discard)
 
-	helmReleaseGvk := resid.Gvk{Group: "helm.fluxcd.io", Version: "v1", Kind: "HelmRelease"}
+	gvk := p.targetGvks()[0]
+	undefinedVars := &undefinedGlobalVarError{}
+	var chartErrs chartErrors
 	for _, chart := range p.Charts {
-		// replace references of HelmReleases
-		id := resid.NewResId(helmReleaseGvk, chart.Name)
-		origin, err := m.GetById(id)
-		if err != nil {
-			return err
+		enabled, err := p.isEnabled(chart)
+		if err = undefinedVars.collect(err, chart.Name, "enabled"); err != nil {
+			chartErrs = append(chartErrs, errors.Wrapf(err, "chart %s", chart.Name))
+			continue
 		}
-		if origin == nil {
-			p.Logger.Println("Can't find HelmRelease name: " + chart.Name)
+		if !enabled {
 			continue
 		}
-
-		overrideChartResource, err := p.getChartResource(chart.Source)
-		if err != nil {
-			return err
+		metadata := map[string]interface{}{"name": chart.Name}
+		if chart.Namespace != "" {
+			metadata["namespace"] = chart.Namespace
 		}
-		err = p.applyPatch(origin, overrideChartResource)
-		if err != nil {
-			return err
+		stub := p.h.ResmapFactory().RF().FromMap(map[string]interface{}{
+			"apiVersion": gvk.ApiVersion(),
+			"kind":       gvk.Kind,
+			"metadata":   metadata,
+		})
+		_, err = p.patchRelease(chart, stub)
+		if err = undefinedVars.collect(err, chart.Name, ""); err != nil {
+			chartErrs = append(chartErrs, errors.Wrapf(err, "chart %s", chart.Name))
 		}
+	}
+	if err := undefinedVars.orNil(); err != nil {
+		chartErrs = append(chartErrs, err)
+	}
+	if len(chartErrs) > 0 {
+		return chartErrs
+	}
+	return nil
+}
 
-		overrideResource, err := p.getResourceFromChart(chart)
-		if err != nil {
-			return err
-		}
+// utf8BOM is the byte order mark which the editors on Windows put at the beginning of a file
+var utf8BOM = []byte("\xef\xbb\xbf")
 
-		err = p.applyPatch(origin, overrideResource)
-		if err != nil {
-			return err
-		}
+// normalizeText strips the leading BOM of content and converts CRLF line endings to LF,
+// which would leave \r at the end of the keys and the values otherwise
+func normalizeText(content []byte) []byte {
+	content = bytes.TrimPrefix(content, utf8BOM)
+	if !bytes.Contains(content, []byte("\r\n")) {
+		return content
 	}
-	return nil
+	return bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
 }
 
-func (p *plugin) applyPatch(resource, patch *resource.Resource) error {
-	node, err := filtersutil.GetRNode(patch)
+// loadFile returns the normalized content of the file at path loaded by the loader of the plugin
+func (p *plugin) loadFile(path string) ([]byte, error) {
+	content, err := p.h.Loader().Load(path)
 	if err != nil {
-		return err
-	}
-	n, ns := resource.GetName(), resource.GetNamespace()
-	err = filtersutil.ApplyToJSON(patchstrategicmerge.Filter{
-		Patch: node,
-	}, resource)
-	if !resource.IsNilOrEmpty() {
-		resource.SetName(n)
-		resource.SetNamespace(ns)
+		return nil, err
 	}
-	return err
+	return normalizeText(content), nil
 }
 
-func (p *plugin) getChartResource(chartSource ChartSource) (r *resource.Resource, err error) {
-	patchChartMap := map[string]interface{}{}
-	if chartSource.Repository != "" {
-		repository, err := p.replaceGlobalVar(chartSource.Repository)
-		if err != nil {
-			return nil, err
-		}
-		patchChartMap["repository"] = repository
-	}
+// configMapKey is the key of the config in data of a ConfigMap wrapping it
+const configMapKey = "config"
 
-	if chartSource.Version != "" {
-		version, err := p.replaceGlobalVar(chartSource.Version)
-		if err != nil {
-			return nil, err
-		}
-		patchChartMap["version"] = version
+// unwrapConfigMap returns data.config of c if c is a ConfigMap, or c as it is
+func unwrapConfigMap(c []byte) ([]byte, error) {
+	var configMap struct {
+		Kind string            `json:"kind"`
+		Data map[string]string `json:"data"`
+	}
+	if err := yaml.Unmarshal(c, &configMap); err != nil || configMap.Kind != "ConfigMap" {
+		// the config which is not a ConfigMap is reported by unmarshalling it
+		return c, nil
+	}
+	config, ok := configMap.Data[configMapKey]
+	if !ok {
+		return nil, errors.New("ConfigMap has no data." + configMapKey)
 	}
+	return normalizeText([]byte(config)), nil
+}
 
-	if chartSource.Name != "" {
-		name, err := p.replaceGlobalVar(chartSource.Name)
+// checkConfigFields fails if the config c has a field unknown to the plugin.
+// apiVersion, kind and metadata of the config are not the fields of the plugin but allowed.
+func checkConfigFields(c []byte) error {
+	config := map[string]interface{}{}
+	if err := yaml.Unmarshal(c, &config); err != nil {
+		return err
+	}
+	delete(config, "apiVersion")
+	delete(config, "kind")
+	delete(config, "metadata")
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(configJSON))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&plugin{}); err != nil {
+		return err
+	}
+	// GlobalsFile unmarshals itself without the decoder, so the entries of globalsFrom are checked apart
+	entries, _ := config["globalsFrom"].([]interface{})
+	for i, entry := range entries {
+		if _, isMap := entry.(map[string]interface{}); !isMap {
+			continue
+		}
+		entryJSON, err := json.Marshal(entry)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		type globalsFile GlobalsFile
+		decoder = json.NewDecoder(bytes.NewReader(entryJSON))
+		decoder.DisallowUnknownFields()
+		if err = decoder.Decode(&globalsFile{}); err != nil {
+			return errors.Wrapf(err, "globalsFrom.%d", i)
 		}
-		patchChartMap["name"] = name
 	}
+	return nil
+}
 
-	if chartSource.Type != "" {
-		chartType, err := p.replaceGlobalVar(chartSource.Type)
-		if err != nil {
-			return nil, err
+// expandChartNames replaces a chart with names by the copies of it for each name
+func (p *plugin) expandChartNames() error {
+	var charts []ReplacedChart
+	for _, chart := range p.Charts {
+		if len(chart.Names) == 0 {
+			charts = append(charts, chart)
+			continue
+		}
+		if chart.Name != "" {
+			return fmt.Errorf("chart %s can not have both name and names", chart.Name)
+		}
+		for _, name := range chart.Names {
+			named := chart
+			named.Name = name
+			named.Names = nil
+			charts = append(charts, named)
 		}
-		patchChartMap["type"] = chartType
 	}
-
-	resource := p.h.ResmapFactory().RF().FromMap(map[string]interface{}{
-		"spec": map[string]interface{}{
-			"chart": patchChartMap,
-		},
-	})
-
-	return resource, nil
+	p.Charts = charts
+	return nil
 }
 
-func (p *plugin) getResourceFromChart(replacedChart ReplacedChart) (r *resource.Resource, err error) {
-	patchMap := map[string]interface{}{}
-
-	for inlinePath, val := range replacedChart.Override {
-		newVal, err := p.replaceGlobalVar(val)
-		if err != nil {
-			return nil, err
+// expandForEach replaces a chart with forEach by the copies of it for each item of global variables.
+// The item shadows globals of the chart, and the global variables in name are replaced with them.
+// The global variables in name of the other charts are replaced as well.
+func (p *plugin) expandForEach() error {
+	var charts []ReplacedChart
+	for _, chart := range p.Charts {
+		if len(chart.ForEach) == 0 {
+			name, err := p.resolveChartName(chart)
+			if err != nil {
+				return errors.Wrapf(err, "invalid name of chart %s", chart.Name)
+			}
+			chart.Name = name
+			charts = append(charts, chart)
+			continue
+		}
+		for i, item := range chart.ForEach {
+			expanded := chart
+			expanded.ForEach = nil
+			expanded.Globals = make(map[string]interface{}, len(chart.Globals)+len(item))
+			mergeValues(expanded.Globals, chart.Globals)
+			mergeValues(expanded.Globals, item)
+			name, err := p.resolveChartName(expanded)
+			if err != nil {
+				return errors.Wrapf(err, "invalid name of forEach.%d of chart %s", i, chart.Name)
+			}
+			expanded.Name = name
+			charts = append(charts, expanded)
 		}
-		paths := splitButIgnoreEscapedDot(inlinePath, "\uffff")
-		p.createMapFromPaths(patchMap, paths, newVal)
 	}
-
-	resource := p.h.ResmapFactory().RF().FromMap(map[string]interface{}{
-		"spec": map[string]interface{}{
-			"values": patchMap,
-		},
-	})
-	return resource, nil
+	p.Charts = charts
+	return nil
 }
 
-// inlinePath is a path string using json dot notation
-// i.e. "conf.ceph.admin_keyring"
-func (p *plugin) createMapFromPaths(chart map[string]interface{}, paths []string, val interface{}) map[string]interface{} {
-	currentPath := paths[0]
-	if len(paths) == 1 {
-		chart[currentPath] = val
-		return chart
+// resolveChartName returns name of chart replacing the global variables in it, i.e. app-$(env).
+// The implicit global variables of HelmRelease are not known until it is found by name.
+func (p *plugin) resolveChartName(chart ReplacedChart) (string, error) {
+	if !strings.Contains(chart.Name, "$(") {
+		return chart.Name, nil
 	}
-
-	if chart[currentPath] == nil {
-		chart[currentPath] = map[string]interface{}{}
+	globals := make(map[string]interface{}, len(p.Global)+len(chart.Globals))
+	for name, val := range p.Global {
+		globals[name] = val
+	}
+	for name, val := range chart.Globals {
+		globals[name] = val
+	}
+	name, err := p.replaceGlobalVar(chart.Name, globals)
+	if err != nil {
+		return "", err
 	}
-	chart[currentPath] = p.createMapFromPaths(chart[currentPath].(map[string]interface{}), paths[1:], val)
-	return chart
+	return fmt.Sprintf("%v", name), nil
 }
 
-func (p *plugin) replaceGlobalVar(original interface{}) (interface{}, error) {
-	valueType := reflect.ValueOf(original).Kind()
-	var inlineStr string
-	// type checking of override value
-	if valueType == reflect.Float64 || valueType == reflect.Float32 || valueType == reflect.Int {
-		return original, nil
-	} else if valueType == reflect.String {
-		inlineStr = original.(string)
-	} else if valueType == reflect.Slice || valueType == reflect.Map {
-		val, _ := yaml.Marshal(original)
-		inlineStr = string(val)
+// checkDuplicateCharts fails if charts share the same name and namespace, or merges override of them with mergeDuplicates.
+// The charts matching name as a regular expression can share the same one.
+func (p *plugin) checkDuplicateCharts() error {
+	indexes := map[string]int{}
+	var charts []ReplacedChart
+	var duplicates []string
+	for _, chart := range p.Charts {
+		if chart.NameRegex {
+			charts = append(charts, chart)
+			continue
+		}
+		key := chart.Namespace + "/" + chart.Name
+		i, isDuplicate := indexes[key]
+		if !isDuplicate {
+			indexes[key] = len(charts)
+			charts = append(charts, chart)
+			continue
+		}
+		if !p.MergeDuplicates {
+			if !containsString(duplicates, chart.Name) {
+				duplicates = append(duplicates, chart.Name)
+			}
+			continue
+		}
+		// the override of the later chart wins
+		override := Override{}
+		mergeValues(override, charts[i].Override)
+		mergeValues(override, chart.Override)
+		charts[i].Override = override
 	}
-	re := regexp.MustCompile(`\$\(([^\(\)])+\)`)
-	isMatched := re.MatchString(inlineStr)
-
-	// no global variable
-	if !isMatched {
-		return original, nil
+	if len(duplicates) > 0 {
+		return errors.New("duplicate charts named " + strings.Join(duplicates, ", "))
 	}
+	p.Charts = charts
+	return nil
+}
 
-	for isMatched {
-		findStr := re.FindString(inlineStr)
-		globalVar := p.Global[findStr[2:len(findStr)-1]]
-
-		// return error if global variable is not defined
-		if globalVar == nil {
-			return nil, errors.New("Can not found global variable named " + findStr)
+// loadGlobalsFrom merges the global variables in the files of globalsFrom underneath global.
+// The later file wins, and global wins over all files.
+// The global variables of the file with prefix are nested in the mapping of prefix,
+// and the same name defined in the files with the same prefix is an error.
+func (p *plugin) loadGlobalsFrom() error {
+	if len(p.GlobalsFrom) == 0 {
+		return nil
+	}
+	globals := map[string]interface{}{}
+	// definedIn is the file of each prefixed global variable
+	definedIn := map[string]string{}
+	for _, file := range p.GlobalsFrom {
+		content, err := p.loadFile(file.Path)
+		if err != nil {
+			return errors.Wrapf(err, "can not read globalsFrom %s", file.Path)
 		}
-
-		if findStr == inlineStr {
-			return globalVar, nil
+		fileGlobals, err := unmarshalDocuments(content)
+		if err != nil {
+			return errors.Wrapf(err, "can not parse globalsFrom %s", file.Path)
 		}
-
-		inlineStr = strings.Replace(inlineStr, findStr, fmt.Sprintf("%v", globalVar), -1)
-		isMatched = re.MatchString(inlineStr)
+		if file.Prefix == "" {
+			mergeValues(globals, fileGlobals)
+			continue
+		}
+		for _, name := range sortedKeys(fileGlobals) {
+			prefixedName := file.Prefix + "." + name
+			if path, ok := definedIn[prefixedName]; ok {
+				return fmt.Errorf("global variable %s is defined in both globalsFrom %s and %s", prefixedName, path, file.Path)
+			}
+			definedIn[prefixedName] = file.Path
+		}
+		mergeValues(globals, map[string]interface{}{file.Prefix: fileGlobals})
 	}
+	mergeValues(globals, p.Global)
+	p.Global = globals
+	return nil
+}
 
-	if valueType != reflect.String {
-		err := yaml.Unmarshal([]byte(inlineStr), &original)
-		return original, err
+// applyGlobalProfile merges the profile of activeProfile over global.
+// activeProfile of $(NAME) is read from the environment variable NAME, and the empty one selects no profile.
+func (p *plugin) applyGlobalProfile() error {
+	name := p.ActiveProfile
+	if strings.HasPrefix(name, "$(") && strings.HasSuffix(name, ")") {
+		envName := name[2 : len(name)-1]
+		envVar, ok := os.LookupEnv(envName)
+		if !ok {
+			return fmt.Errorf("environment variable %s of activeProfile is not set", envName)
+		}
+		name = envVar
+	}
+	if name == "" {
+		return nil
+	}
+	profile, ok := p.GlobalProfiles[name]
+	if !ok {
+		return errors.New("unknown activeProfile " + name)
+	}
+	globals := deepCopyValue(p.Global).(map[string]interface{})
+	mergeValues(globals, profile)
+	p.Global = globals
+	p.Logger.Debugf("Merged globalProfile %s over global", name)
+	return nil
+}
+
+// loadActiveCharts sets activeCharts to the names in the environment variable of ChartsFromEnv
+func (p *plugin) loadActiveCharts() {
+	if p.ChartsFromEnv == "" {
+		return
+	}
+	names := strings.TrimSpace(os.Getenv(p.ChartsFromEnv))
+	if names == "" {
+		return
+	}
+	charts := map[string]bool{}
+	for _, chart := range p.Charts {
+		charts[chart.Name] = true
+	}
+	p.activeCharts = map[string]bool{}
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if !charts[name] {
+			p.Logger.Warnf("Can't find chart %s of %s", name, p.ChartsFromEnv)
+		}
+		p.activeCharts[name] = true
+	}
+}
+
+// isMultiDocument reports whether content has more than one yaml document
+func isMultiDocument(content []byte) bool {
+	decoder := kyaml.NewDecoder(bytes.NewReader(content))
+	for count := 0; count < 2; count++ {
+		var node kyaml.Node
+		if err := decoder.Decode(&node); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// unmarshalDocuments returns the mappings of the yaml documents in content merged in order,
+// and the later document wins.
+func unmarshalDocuments(content []byte) (map[string]interface{}, error) {
+	merged := map[string]interface{}{}
+	decoder := kyaml.NewDecoder(bytes.NewReader(content))
+	for {
+		var node kyaml.Node
+		if err := decoder.Decode(&node); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		// each document is unmarshalled in the same way as a file of a single document
+		doc, err := kyaml.Marshal(&node)
+		if err != nil {
+			return nil, err
+		}
+		docMap := map[string]interface{}{}
+		if err = yaml.Unmarshal(doc, &docMap); err != nil {
+			return nil, err
+		}
+		mergeValues(merged, docMap)
+	}
+	return merged, nil
+}
+
+func (p *plugin) Transform(m resmap.ResMap) error {
+	return p.TransformContext(context.Background(), m)
+}
+
+// TransformContext is Transform aborted with the error of ctx if it is done before a chart
+func (p *plugin) TransformContext(ctx context.Context, m resmap.ResMap) (err error) {
+	if p.ValidateOnly {
+		return nil
+	}
+	// undefined global variables are reported at once after all charts
+	undefinedVars := &undefinedGlobalVarError{}
+	skipped := 0
+	var reports []string
+	p.stats = TransformStats{}
+	releases, err := p.helmReleases(m)
+	if err != nil {
+		return err
+	}
+	index := p.indexHelmReleases(releases)
+	p.changed = map[*resource.Resource]bool{}
+	charts, err := p.sortCharts()
+	if err != nil {
+		return err
+	}
+	// the errors of charts are returned together after all charts in collect mode
+	var chartErrs chartErrors
+	failChart := func(chart ReplacedChart, err error) error {
+		if p.ErrorMode != errorModeCollect {
+			return err
+		}
+		chartErrs = append(chartErrs, errors.Wrapf(err, "chart %s", chart.Name))
+		return nil
+	}
+	for _, chart := range charts {
+		if err = ctx.Err(); err != nil {
+			return errors.Wrapf(err, "transform aborted before chart %s", chart.Name)
+		}
+		enabled, err := p.isEnabled(chart)
+		if err != nil {
+			if err = undefinedVars.collect(err, chart.Name, "enabled"); err != nil {
+				if err = failChart(chart, err); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !enabled {
+			p.Logger.with(chart.Name, "").Debugf("Skipped disabled chart %s", chart.Name)
+			p.stats.SkippedCharts++
+			continue
+		}
+
+		// replace references of HelmReleases
+		origins, err := p.findHelmReleases(releases, index, chart)
+		if err != nil {
+			if err = failChart(chart, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(origins) == 0 {
+			if p.Strict {
+				if err = failChart(chart, &classifiedError{errors.New("Can't find HelmRelease name: " + chart.Name), ErrMissingRelease}); err != nil {
+					return err
+				}
+				continue
+			}
+			p.Logger.with(chart.Name, "").Warnf("Can't find HelmRelease name: %s", chart.Name)
+			reports = append(reports, fmt.Sprintf("chart %s: skipped without HelmRelease", chart.Name))
+			skipped++
+			p.stats.SkippedCharts++
+			continue
+		}
+
+		patched := false
+		for _, origin := range origins {
+			if p.isSkipped(origin) {
+				p.Logger.with(chart.Name, "").Debugf("Skipped HelmRelease %s with %s", origin.GetName(), p.skipKey())
+				continue
+			}
+			report, err := p.transformRelease(chart, origin)
+			if err == nil {
+				patched = true
+				p.stats.Releases++
+			}
+			if err = undefinedVars.collect(err, origin.GetName(), ""); err != nil {
+				if err = failChart(chart, err); err != nil {
+					return err
+				}
+				continue
+			}
+			if report != "" {
+				reports = append(reports, report)
+			}
+		}
+		if patched {
+			p.stats.Charts++
+		}
+	}
+	if skipped > 0 {
+		p.Logger.Infof("Skipped %d of %d charts without HelmRelease", skipped, len(p.Charts))
+	}
+	if err = undefinedVars.orNil(); err != nil {
+		if len(chartErrs) == 0 {
+			return err
+		}
+		chartErrs = append(chartErrs, err)
+	}
+	if len(chartErrs) > 0 {
+		return chartErrs
+	}
+	if p.OutputChangedOnly {
+		if err = p.removeUnchanged(m); err != nil {
+			return err
+		}
+	}
+	return p.writeReport(reports)
+}
+
+// removeUnchanged removes the resources which are not changed by any chart from m
+func (p *plugin) removeUnchanged(m resmap.ResMap) error {
+	for _, r := range m.Resources() {
+		if p.changed[r] {
+			continue
+		}
+		if err := m.Remove(r.CurId()); err != nil {
+			return err
+		}
+	}
+	p.Logger.Debugf("Kept %d changed resources in output", m.Size())
+	return nil
+}
+
+// TransformStats are the counts of Transform for the callers embedding the plugin
+type TransformStats struct {
+	// Charts is the number of charts patching at least one HelmRelease
+	Charts int `json:"charts"`
+	// SkippedCharts is the number of charts disabled or without HelmRelease
+	SkippedCharts int `json:"skippedCharts"`
+	// Releases is the number of HelmReleases patched
+	Releases int `json:"releases"`
+	// Substitutions is the number of global variables substituted
+	Substitutions int `json:"substitutions"`
+	// Paths is the number of override paths applied
+	Paths int `json:"paths"`
+}
+
+// Stats returns the counts of the last Transform
+func (p *plugin) Stats() TransformStats {
+	return p.stats
+}
+
+// chartErrors are the errors of charts collected in collect mode
+type chartErrors []error
+
+func (e chartErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Is reports whether any of the errors matches target
+func (e chartErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// isEnabled reports whether chart is in chartsFromEnv and enabled, replacing the global variables in enabled of it
+func (p *plugin) isEnabled(chart ReplacedChart) (bool, error) {
+	if p.activeCharts != nil && !p.activeCharts[chart.Name] {
+		return false, nil
+	}
+	if chart.Enabled == nil {
+		return true, nil
+	}
+	enabled, err := p.replaceGlobalVarAt(chart.Enabled, p.chartGlobals(chart, chart.Name, chart.Namespace), chart.Name, "enabled")
+	if err != nil {
+		return false, err
+	}
+	switch v := enabled.(type) {
+	case bool:
+		return v, nil
+	case string:
+		if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+			return b, nil
+		}
+	}
+	return false, fmt.Errorf("enabled of chart %s is not a bool: %v", chart.Name, enabled)
+}
+
+// skipKey returns SkipKey or the default of it
+func (p *plugin) skipKey() string {
+	if p.SkipKey == "" {
+		return defaultSkipKey
+	}
+	return p.SkipKey
+}
+
+// isSkipped reports whether r has the annotation or the label of skipKey which is true
+func (p *plugin) isSkipped(r *resource.Resource) bool {
+	key := p.skipKey()
+	for _, m := range []map[string]string{r.GetAnnotations(), r.GetLabels()} {
+		if skip, err := strconv.ParseBool(strings.TrimSpace(m[key])); err == nil && skip {
+			return true
+		}
+	}
+	return false
+}
+
+// transformRelease overrides the chart source and values of origin, and returns the report of it
+func (p *plugin) transformRelease(chart ReplacedChart, origin *resource.Resource) (string, error) {
+	p.substitutions = 0
+
+	if _, err := getSpecMap(origin, "chart"); err != nil {
+		return "", err
+	}
+
+	// patch a copy to leave the HelmRelease untouched in dry run
+	target := origin
+	if p.DryRun {
+		target = origin.DeepCopy()
+	}
+	var before *resource.Resource
+	if p.OutputChangedOnly && !p.DryRun {
+		before = origin.DeepCopy()
+	}
+	overrideChartResource, err := p.patchRelease(chart, target)
+	if err != nil {
+		return "", err
+	}
+	// kustomize drops the HelmRelease which can not be written as yaml from the output
+	if _, err = target.AsYAML(); err != nil {
+		return "", errors.Wrapf(err, "can not write HelmRelease of chart %s", chart.Name)
+	}
+	if p.OutputChangedOnly {
+		// in dry run, the HelmRelease which would be changed is kept
+		if before == nil {
+			before = origin
+		}
+		changed, err := isChanged(before, target)
+		if err != nil {
+			return "", err
+		}
+		if changed {
+			p.changed[origin] = true
+			if list, ok := p.lists[origin]; ok {
+				p.changed[list] = true
+			}
+		}
+	}
+	if p.VerifyIdempotent {
+		if err = p.verifyIdempotent(chart, target); err != nil {
+			return "", err
+		}
+	}
+
+	if p.DryRun {
+		if err = p.logDiff(origin.GetName(), origin, target); err != nil {
+			return "", err
+		}
+	}
+
+	if p.DumpValuesDir != "" {
+		if err = p.dumpValues(target); err != nil {
+			return "", errors.Wrapf(err, "can not dump values of chart %s", chart.Name)
+		}
+	}
+
+	return p.reportChart(chart, origin.GetName(), overrideChartResource)
+}
+
+// isChanged reports whether after differs from before
+func isChanged(before, after *resource.Resource) (bool, error) {
+	beforeMap, err := before.Map()
+	if err != nil {
+		return false, err
+	}
+	afterMap, err := after.Map()
+	if err != nil {
+		return false, err
+	}
+	return !equalValues(beforeMap, afterMap), nil
+}
+
+// patchRelease patches target with source, override and valuesFrom of chart,
+// and returns the patch of chart source.
+func (p *plugin) patchRelease(chart ReplacedChart, target *resource.Resource) (*resource.Resource, error) {
+	undefinedVars := &undefinedGlobalVarError{}
+	globals := p.chartGlobals(chart, target.GetName(), target.GetNamespace())
+	if chart.RawValues {
+		globals = nil
+	}
+	overrideChartResource, err := p.getChartResource(chart, target.GetName(), target.GetGvk(), globals)
+	if err = undefinedVars.collect(err, "", ""); err != nil {
+		return nil, err
+	}
+	// the values are pruned before the override to build the override from the pruned ones
+	err = p.pruneValues(chart, target, globals)
+	if err = undefinedVars.collect(err, "", ""); err != nil {
+		return nil, err
+	}
+	overrideResource, err := p.getResourceFromChart(chart, target, globals)
+	if err = undefinedVars.collect(err, "", ""); err != nil {
+		return nil, err
+	}
+	valuesFromResource, err := p.getValuesFromResource(chart, target, globals)
+	if err = undefinedVars.collect(err, "", ""); err != nil {
+		return nil, err
+	}
+	if err = undefinedVars.orNil(); err != nil {
+		return nil, err
+	}
+
+	err = p.applyPatch(target, overrideChartResource)
+	if err != nil {
+		return nil, &classifiedError{errors.Wrapf(err, "can not patch chart %s with %s", chart.Name, patchPreview(overrideChartResource)), ErrPatchFailed}
+	}
+	if err = p.checkSourceRef(chart, target, overrideChartResource); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case overrideResource == nil:
+	case p.patchStrategy(chart) == patchStrategyMerge:
+		err = p.mergeResourceValues(target, overrideResource)
+	case p.patchStrategy(chart) == patchStrategyJSON:
+		err = applyJSONPatch(target, overrideResource)
+	default:
+		err = p.applyPatch(target, overrideResource)
+	}
+	if err != nil {
+		return nil, &classifiedError{errors.Wrapf(err, "can not patch values of chart %s with %s", chart.Name, patchPreview(overrideResource)), ErrPatchFailed}
+	}
+
+	if valuesFromResource != nil {
+		if err = p.applyPatch(target, valuesFromResource); err != nil {
+			return nil, &classifiedError{errors.Wrapf(err, "can not patch valuesFrom of chart %s with %s", chart.Name, patchPreview(valuesFromResource)), ErrPatchFailed}
+		}
+	}
+	return overrideChartResource, nil
+}
+
+// pruneValues removes the paths in delete of chart from the values of target.
+// The paths which do not exist are ignored unless strict. The indices of lists refer to the values
+// before the removal, so the deeper paths and the higher indices are removed first.
+func (p *plugin) pruneValues(chart ReplacedChart, target *resource.Resource, globals map[string]interface{}) error {
+	if len(chart.Delete) == 0 {
+		return nil
+	}
+	values, err := getMapAt(target, p.valuesPaths())
+	if err != nil {
+		return err
+	}
+	type pathDeletion struct {
+		paths []string
+		index int
+	}
+	undefinedVars := &undefinedGlobalVarError{}
+	var deletions []pathDeletion
+	for i, inlinePath := range chart.Delete {
+		path := fmt.Sprintf("delete.%d", i)
+		resolvedPath, err := p.replaceGlobalVarAt(inlinePath, globals, chart.Name, path)
+		if err != nil {
+			if err = undefinedVars.collect(err, "", path); err != nil {
+				return err
+			}
+			continue
+		}
+		paths, err := splitOverridePath(fmt.Sprintf("%v", resolvedPath))
+		if err != nil {
+			return errors.Wrapf(err, "invalid delete path %s of chart %s", inlinePath, chart.Name)
+		}
+		if _, ok := lookupValue(values, paths); !ok {
+			if p.Strict {
+				return fmt.Errorf("delete path %s of chart %s does not exist in %s %s", inlinePath, chart.Name, target.GetKind(), target.GetName())
+			}
+			continue
+		}
+		paths, index, isIndex := listIndex(values, paths)
+		if !isIndex {
+			index = -1
+		}
+		isDuplicate := false
+		for _, d := range deletions {
+			isDuplicate = isDuplicate || equalPaths(d.paths, paths)
+		}
+		if !isDuplicate {
+			deletions = append(deletions, pathDeletion{paths, index})
+		}
+	}
+	if err = undefinedVars.orNil(); err != nil {
+		return err
+	}
+	if len(deletions) == 0 {
+		return nil
+	}
+	sort.SliceStable(deletions, func(i, j int) bool {
+		if len(deletions[i].paths) != len(deletions[j].paths) {
+			return len(deletions[i].paths) > len(deletions[j].paths)
+		}
+		return deletions[i].index > deletions[j].index
+	})
+	for _, d := range deletions {
+		removeValue(values, d.paths)
+	}
+	return setMapAt(target, p.valuesPaths(), values)
+}
+
+// removeValue removes the value at paths of current, and returns current which is a new one
+// if an item is removed from the list, and whether the value exists
+func removeValue(current interface{}, paths []string) (interface{}, bool) {
+	switch v := current.(type) {
+	case map[string]interface{}:
+		child, ok := v[paths[0]]
+		if !ok {
+			return v, false
+		}
+		if len(paths) == 1 {
+			delete(v, paths[0])
+			return v, true
+		}
+		newChild, removed := removeValue(child, paths[1:])
+		if removed {
+			v[paths[0]] = newChild
+		}
+		return v, removed
+	case []interface{}:
+		index, isIndex := parseIndex(paths[0])
+		if index < 0 {
+			index += len(v)
+		}
+		if !isIndex || index < 0 || index >= len(v) {
+			return v, false
+		}
+		if len(paths) == 1 {
+			return append(v[:index:index], v[index+1:]...), true
+		}
+		newItem, removed := removeValue(v[index], paths[1:])
+		if removed {
+			v[index] = newItem
+		}
+		return v, removed
+	}
+	return current, false
+}
+
+// verifyIdempotent patches a copy of target with chart again without logs,
+// and fails if the copy is not the same as target.
+func (p *plugin) verifyIdempotent(chart ReplacedChart, target *resource.Resource) error {
+	logger, substitutions, stats := p.Logger, p.substitutions, p.stats
+	defer func() {
+		p.Logger, p.substitutions, p.stats = logger, substitutions, stats
+	}()
+	p.Logger, _ = newLeveledLogger("silent", "", io.Discard)
+
+	again := target.DeepCopy()
+	if _, err := p.patchRelease(chart, again); err != nil {
+		return errors.Wrapf(err, "can not patch %s %s again", target.GetKind(), target.GetName())
+	}
+	targetMap, err := target.Map()
+	if err != nil {
+		return err
+	}
+	againMap, err := again.Map()
+	if err != nil {
+		return err
+	}
+	if !equalValues(targetMap, againMap) {
+		return fmt.Errorf("chart %s is not idempotent, %s %s differs when patched again: %s", chart.Name, target.GetKind(), target.GetName(), patchPreview(again))
+	}
+	return nil
+}
+
+// maxPatchPreview is the length of patch shown in the errors
+const maxPatchPreview = 200
+
+// patchPreview returns the patch as json, which is truncated to maxPatchPreview
+func patchPreview(patch *resource.Resource) string {
+	patchJSON, err := patch.MarshalJSON()
+	if err != nil {
+		return "unprintable patch"
+	}
+	if len(patchJSON) > maxPatchPreview {
+		return string(patchJSON[:maxPatchPreview]) + "..."
+	}
+	return string(patchJSON)
+}
+
+// logDiff logs the diff of yaml from origin to patched
+func (p *plugin) logDiff(chartName string, origin, patched *resource.Resource) error {
+	originYaml, err := origin.AsYAML()
+	if err != nil {
+		return err
+	}
+	patchedYaml, err := patched.AsYAML()
+	if err != nil {
+		return err
+	}
+	diff := diffLines(
+		strings.Split(strings.TrimSuffix(string(originYaml), "\n"), "\n"),
+		strings.Split(strings.TrimSuffix(string(patchedYaml), "\n"), "\n"))
+	p.Logger.with(chartName, "").Infof("Diff of chart %s:\n%s", chartName, strings.Join(diff, "\n"))
+	return nil
+}
+
+// diffLines returns the lines of a and b prefixed with "- " if removed from a,
+// "+ " if added to b and "  " if kept.
+func diffLines(a, b []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var diff []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			diff = append(diff, "  "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, "- "+a[i])
+			i++
+		default:
+			diff = append(diff, "+ "+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		diff = append(diff, "- "+a[i])
+	}
+	for ; j < len(b); j++ {
+		diff = append(diff, "+ "+b[j])
+	}
+	return diff
+}
+
+// reportChart describes the chart source and the override paths applied to HelmRelease named name
+func (p *plugin) reportChart(chart ReplacedChart, name string, chartResource *resource.Resource) (string, error) {
+	chartMap, err := getSpecMap(chartResource, "chart")
+	if err != nil {
+		return "", err
+	}
+	// json sorts the keys of mapping
+	source, err := json.Marshal(chartMap)
+	if err != nil {
+		return "", err
+	}
+
+	paths := sortedKeys(p.mergedOverride(chart))
+
+	return fmt.Sprintf("chart %s: source %s, override [%s], %d global variables substituted",
+		name, source, strings.Join(paths, ", "), p.substitutions), nil
+}
+
+// writeReport writes reports to ReportPath or stderr if Report is enabled
+func (p *plugin) writeReport(reports []string) error {
+	if !p.Report {
+		return nil
+	}
+	content := strings.Join(reports, "\n") + "\n"
+	if p.ReportPath == "" {
+		_, err := fmt.Fprint(os.Stderr, content)
+		return err
+	}
+	return os.WriteFile(p.ReportPath, []byte(content), 0644)
+}
+
+// dumpValues writes the values of the patched resource to <dumpValuesDir>/<name>.yaml
+func (p *plugin) dumpValues(patched *resource.Resource) error {
+	values, err := getMapAt(patched, p.valuesPaths())
+	if err != nil {
+		return err
+	}
+	if values == nil {
+		values = map[string]interface{}{}
+	}
+	content, err := yaml.Marshal(values)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(p.DumpValuesDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(p.DumpValuesDir, patched.GetName()+".yaml"), content, 0644)
+}
+
+// targetGvks returns the kinds of resource to override.
+// The configured targetGvk takes place of the known HelmRelease kinds.
+func (p *plugin) targetGvks() []resid.Gvk {
+	if p.TargetGvk != nil {
+		return []resid.Gvk{*p.TargetGvk}
+	}
+	return helmReleaseGvks
+}
+
+// findHelmReleases returns the HelmReleases which chart overrides.
+// The name of chart is matched as a regular expression if nameRegex is set.
+func (p *plugin) findHelmReleases(releases []*resource.Resource, index releaseIndex, chart ReplacedChart) ([]*resource.Resource, error) {
+	if !chart.NameRegex {
+		origin, err := p.findHelmRelease(index, chart.Name, chart.Namespace)
+		if err != nil || origin == nil {
+			return nil, err
+		}
+		return []*resource.Resource{origin}, nil
+	}
+
+	re, err := regexp.Compile("^(?:" + chart.Name + ")$")
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid name regex of chart %s", chart.Name)
+	}
+	var origins []*resource.Resource
+	for _, r := range releases {
+		if re.MatchString(r.GetName()) && isInNamespace(r, chart.Namespace) {
+			origins = append(origins, r)
+		}
+	}
+	return origins, nil
+}
+
+// isInNamespace reports whether r is in namespace, which is true for any namespace if it is empty
+func isInNamespace(r *resource.Resource, namespace string) bool {
+	return namespace == "" || r.CurId().IsNsEquals(resid.NewResIdWithNamespace(r.GetGvk(), r.GetName(), namespace))
+}
+
+// isTarget reports whether gvk is one of the target kinds
+func (p *plugin) isTarget(gvk resid.Gvk) bool {
+	for _, target := range p.targetGvks() {
+		if gvk.Equals(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseIndex is the resources of target kinds keyed by their current and previous names
+type releaseIndex map[string][]*resource.Resource
+
+// sortCharts returns the charts sorted after the charts in dependsOn of them, keeping the order of the others.
+// The names in dependsOn which are not charts are ignored, and a cycle of them is an error.
+func (p *plugin) sortCharts() ([]ReplacedChart, error) {
+	byName := map[string][]int{}
+	for i, chart := range p.Charts {
+		byName[chart.Name] = append(byName[chart.Name], i)
+	}
+	sorted := make([]ReplacedChart, 0, len(p.Charts))
+	// visiting is the chain of charts being sorted, and a visited chart is sorted already
+	var visiting []string
+	visited := make([]bool, len(p.Charts))
+	var visit func(i int) error
+	visit = func(i int) error {
+		if visited[i] {
+			return nil
+		}
+		chart := p.Charts[i]
+		for j, name := range visiting {
+			if name == chart.Name {
+				cycle := append(append([]string{}, visiting[j:]...), name)
+				return errors.New("Cycle in dependsOn of charts: " + strings.Join(cycle, " -> "))
+			}
+		}
+		visiting = append(visiting, chart.Name)
+		for _, dependency := range chart.DependsOn {
+			for _, j := range byName[dependency] {
+				if err := visit(j); err != nil {
+					return err
+				}
+			}
+		}
+		visiting = visiting[:len(visiting)-1]
+		visited[i] = true
+		sorted = append(sorted, chart)
+		return nil
+	}
+	for i := range p.Charts {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// helmReleases returns the resources of target kinds in m including the items of List resources.
+// The item shares the node with the List, so patching it writes back to the List.
+func (p *plugin) helmReleases(m resmap.ResMap) ([]*resource.Resource, error) {
+	p.lists = map[*resource.Resource]*resource.Resource{}
+	var releases []*resource.Resource
+	for _, r := range m.Resources() {
+		if p.isTarget(r.GetGvk()) {
+			releases = append(releases, r)
+			continue
+		}
+		if r.GetKind() != "List" {
+			continue
+		}
+		items, err := r.Pipe(kyaml.Lookup("items"))
+		if err != nil || items == nil {
+			continue
+		}
+		elements, err := items.Elements()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid items of List %s", r.GetName())
+		}
+		for _, item := range elements {
+			release := &resource.Resource{RNode: *item}
+			if p.isTarget(release.GetGvk()) {
+				releases = append(releases, release)
+				p.lists[release] = r
+			}
+		}
+	}
+	return releases, nil
+}
+
+// indexHelmReleases indexes releases with a single pass
+func (p *plugin) indexHelmReleases(releases []*resource.Resource) releaseIndex {
+	index := releaseIndex{}
+	for _, r := range releases {
+		indexed := map[string]bool{}
+		for _, id := range append(r.PrevIds(), r.CurId()) {
+			if !indexed[id.Name] {
+				indexed[id.Name] = true
+				index[id.Name] = append(index[id.Name], r)
+			}
+		}
+	}
+	return index
+}
+
+// findHelmRelease returns the HelmRelease named name in namespace, trying each target kind in order.
+// The empty namespace matches the default one. It returns nil without error if no HelmRelease has the name.
+func (p *plugin) findHelmRelease(index releaseIndex, name, namespace string) (*resource.Resource, error) {
+	for _, gvk := range p.targetGvks() {
+		id := resid.NewResIdWithNamespace(gvk, name, namespace)
+		var matched []*resource.Resource
+		for _, r := range index[name] {
+			for _, rid := range append(r.PrevIds(), r.CurId()) {
+				if id.Equals(rid) {
+					matched = append(matched, r)
+					break
+				}
+			}
+		}
+		if len(matched) > 1 {
+			return nil, fmt.Errorf("multiple matches for Id %s", id)
+		}
+		if len(matched) == 1 {
+			return matched[0], nil
+		}
+	}
+	return nil, nil
+}
+
+// isFluxV2 reports whether gvk is a HelmRelease of Flux v2(helm-controller).
+func isFluxV2(gvk resid.Gvk) bool {
+	return gvk.Group == "helm.toolkit.fluxcd.io"
+}
+
+func (p *plugin) applyPatch(resource, patch *resource.Resource) error {
+	n, ns := resource.GetName(), resource.GetNamespace()
+	// the patch is applied to a copy of the node of resource, which keeps the comments and
+	// the order of fields, and leaves resource untouched on error
+	nodes, err := patchstrategicmerge.Filter{
+		Patch: &patch.RNode,
+	}.Filter([]*kyaml.RNode{resource.RNode.Copy()})
+	if err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		resource.SetYNode(nil)
+	} else {
+		resource.SetYNode(nodes[0].YNode())
+	}
+	if !resource.IsNilOrEmpty() {
+		resource.SetName(n)
+		resource.SetNamespace(ns)
+	}
+	return nil
+}
+
+// mergeResourceValues deep-merges the values of override into the values of resource,
+// and writes the result back to resource. Lists are replaced, and null removes the key.
+// The fields of override out of the values are patched to resource.
+func (p *plugin) mergeResourceValues(resource, override *resource.Resource) error {
+	fields := override.DeepCopy()
+	valuesPaths := p.valuesPaths()
+	if err := fields.PipeE(kyaml.Lookup(valuesPaths[:len(valuesPaths)-1]...), kyaml.Clear(valuesPaths[len(valuesPaths)-1])); err != nil {
+		return err
+	}
+	if err := p.applyPatch(resource, fields); err != nil {
+		return err
+	}
+
+	values, err := getMapAt(resource, valuesPaths)
+	if err != nil {
+		return err
+	}
+	overrideValues, err := getMapAt(override, valuesPaths)
+	if err != nil {
+		return err
+	}
+	merged := map[string]interface{}{}
+	if overrideValues[patchDirective] == "replace" {
+		values = nil
+	}
+	mergeValues(merged, values)
+	mergePatchValues(merged, overrideValues)
+	delete(merged, patchDirective)
+	return setMapAt(resource, valuesPaths, merged)
+}
+
+// patchStrategy returns patchStrategy of chart, or the default of it
+func (p *plugin) patchStrategy(chart ReplacedChart) string {
+	if chart.PatchStrategy != "" {
+		return chart.PatchStrategy
+	}
+	if p.MergeValues {
+		return patchStrategyMerge
+	}
+	return patchStrategyStrategic
+}
+
+// jsonPatchOperation is an operation of RFC6902 patch
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// applyJSONPatch applies patch to resource as the RFC6902 operations of jsonPatchOperations,
+// which loses the comments and the order of fields of resource
+func applyJSONPatch(resource, patch *resource.Resource) error {
+	current, err := resource.Map()
+	if err != nil {
+		return err
+	}
+	patchMap, err := patch.Map()
+	if err != nil {
+		return err
+	}
+	ops := jsonPatchOperations(current, patchMap, "")
+	if len(ops) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+	nodes, err := patchjson6902.Filter{
+		Patch: string(b),
+	}.Filter([]*kyaml.RNode{resource.RNode.Copy()})
+	if err != nil {
+		return err
+	}
+	resource.SetYNode(nodes[0].YNode())
+	return nil
+}
+
+// jsonPatchOperations returns the operations changing current into patch at pointer.
+// The mappings are compared by key, null removes the key, and the other values are set as a whole.
+func jsonPatchOperations(current, patch map[string]interface{}, pointer string) []jsonPatchOperation {
+	var ops []jsonPatchOperation
+	for _, key := range sortedKeys(patch) {
+		if key == patchDirective {
+			continue
+		}
+		keyPointer := pointer + "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+		val := patch[key]
+		currentVal, exists := current[key]
+		if val == nil {
+			if exists {
+				ops = append(ops, jsonPatchOperation{Op: "remove", Path: keyPointer})
+			}
+			continue
+		}
+		valMap, isMap := val.(map[string]interface{})
+		currentMap, isCurrentMap := currentVal.(map[string]interface{})
+		if isMap && isCurrentMap && valMap[patchDirective] != "replace" {
+			ops = append(ops, jsonPatchOperations(currentMap, valMap, keyPointer)...)
+			continue
+		}
+		if isMap {
+			val = deepCopyValue(valMap)
+			delete(val.(map[string]interface{}), patchDirective)
+		}
+		if exists && equalValues(currentVal, val) {
+			continue
+		}
+		// add replaces the value of key existing already
+		ops = append(ops, jsonPatchOperation{Op: "add", Path: keyPointer, Value: val})
+	}
+	return ops
+}
+
+func (p *plugin) getChartResource(chart ReplacedChart, releaseName string, gvk resid.Gvk, globals map[string]interface{}) (r *resource.Resource, err error) {
+	source := p.chartSource(chart, releaseName)
+	undefinedVars := &undefinedGlobalVarError{}
+	patchChartMap, err := p.replaceChartFields(chart.Name, []chartField{
+		{"repository", source.Repository},
+		{"version", source.Version},
+		{"name", source.Name},
+		{"type", source.Type},
+	}, "source.", globals, undefinedVars)
+	if err != nil {
+		return nil, err
+	}
+
+	specFields, err := p.replaceChartFields(chart.Name, []chartField{
+		{"releaseName", chart.ReleaseName},
+		{"targetNamespace", chart.TargetNamespace},
+		{"interval", chart.Interval},
+	}, "", globals, undefinedVars)
+	if err != nil {
+		return nil, err
+	}
+	if chart.Retries != nil {
+		retries, err := p.replaceGlobalVarAt(chart.Retries, globals, chart.Name, "retries")
+		if err == nil {
+			if retries, err = castToInt(retries); err != nil {
+				return nil, errors.Wrapf(err, "invalid retries of chart %s", chart.Name)
+			}
+			specFields["install"] = map[string]interface{}{
+				"remediation": map[string]interface{}{"retries": retries},
+			}
+		} else if err = undefinedVars.collect(err, "", "retries"); err != nil {
+			return nil, err
+		}
+	}
+
+	var sourceRef map[string]interface{}
+	if chart.SourceRef != nil {
+		sourceRef, err = p.replaceChartFields(chart.Name, []chartField{
+			{"name", chart.SourceRef.Name},
+			{"kind", chart.SourceRef.Kind},
+			{"namespace", chart.SourceRef.Namespace},
+		}, "sourceRef.", globals, undefinedVars)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = undefinedVars.orNil(); err != nil {
+		return nil, err
+	}
+	if isFluxV2(gvk) {
+		patchChartMap = toFluxV2Chart(patchChartMap)
+		// sourceRef wins over repository and type of source
+		if len(sourceRef) > 0 {
+			chartSpec := patchChartMap["spec"].(map[string]interface{})
+			if chartSpec["sourceRef"] == nil {
+				chartSpec["sourceRef"] = map[string]interface{}{}
+			}
+			mergeValues(chartSpec["sourceRef"].(map[string]interface{}), sourceRef)
+		}
+	} else if len(sourceRef) > 0 {
+		p.Logger.with(chart.Name, "sourceRef").Warnf("sourceRef of chart %s is ignored for %s", chart.Name, gvk)
+	}
+
+	specFields["chart"] = patchChartMap
+	resource := p.h.ResmapFactory().RF().FromMap(map[string]interface{}{
+		"spec": specFields,
+	})
+
+	return resource, nil
+}
+
+// checkSourceRef fails if the chart ref of target patched with patch does not match sourceRefPattern.
+// The ref is spec.chart.spec.sourceRef of Flux v2 as kind/namespace/name, or spec.chart.repository of Flux v1,
+// and it is checked only if patch sets it.
+func (p *plugin) checkSourceRef(chart ReplacedChart, target, patch *resource.Resource) error {
+	if p.sourceRefRe == nil {
+		return nil
+	}
+	field, paths := "repository", []string{"spec", "chart", "repository"}
+	if isFluxV2(target.GetGvk()) {
+		field, paths = "sourceRef", []string{"spec", "chart", "spec", "sourceRef"}
+	}
+	patchMap, err := patch.Map()
+	if err != nil {
+		return err
+	}
+	if _, ok := lookupValue(patchMap, paths); !ok {
+		return nil
+	}
+	targetMap, err := target.Map()
+	if err != nil {
+		return err
+	}
+	val, _ := lookupValue(targetMap, paths)
+	ref := fmt.Sprintf("%v", val)
+	if sourceRef, ok := val.(map[string]interface{}); ok {
+		ref = formatSourceRef(sourceRef)
+	}
+	if !p.sourceRefRe.MatchString(ref) {
+		return fmt.Errorf("%s %s of chart %s does not match sourceRefPattern %s", field, ref, chart.Name, p.SourceRefPattern)
+	}
+	return nil
+}
+
+// formatSourceRef returns sourceRef as kind/namespace/name, or kind/name without namespace
+func formatSourceRef(sourceRef map[string]interface{}) string {
+	var fields []string
+	for _, key := range []string{"kind", "namespace", "name"} {
+		if val, ok := sourceRef[key]; ok {
+			fields = append(fields, fmt.Sprintf("%v", val))
+		}
+	}
+	return strings.Join(fields, "/")
+}
+
+// chartField is a field of chart source to replace global variables in
+type chartField struct {
+	key   string
+	value string
+}
+
+// replaceChartFields returns the non-empty fields with global variables replaced.
+// The undefined global variables are collected into undefinedVars with the path of prefix and the key.
+func (p *plugin) replaceChartFields(chart string, fields []chartField, prefix string, globals map[string]interface{}, undefinedVars *undefinedGlobalVarError) (map[string]interface{}, error) {
+	replaced := map[string]interface{}{}
+	for _, field := range fields {
+		if field.value == "" {
+			continue
+		}
+		val, err := p.replaceGlobalVarAt(field.value, globals, chart, prefix+field.key)
+		if err != nil {
+			if err = undefinedVars.collect(err, "", prefix+field.key); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		replaced[field.key] = val
+	}
+	return replaced, nil
+}
+
+// toFluxV2Chart converts the Flux v1 chart fields to the chart template of Flux v2.
+// i.e. name -> spec.chart, version -> spec.version, repository -> spec.sourceRef.name
+// and type -> spec.sourceRef.kind
+func toFluxV2Chart(v1Chart map[string]interface{}) map[string]interface{} {
+	chartSpec := map[string]interface{}{}
+	if name, ok := v1Chart["name"]; ok {
+		chartSpec["chart"] = name
+	}
+	if version, ok := v1Chart["version"]; ok {
+		chartSpec["version"] = version
+	}
+
+	sourceRef := map[string]interface{}{}
+	if repository, ok := v1Chart["repository"]; ok {
+		sourceRef["name"] = repository
+	}
+	if chartType, ok := v1Chart["type"]; ok {
+		kind := fmt.Sprintf("%v", chartType)
+		if k, ok := sourceRefKinds[kind]; ok {
+			kind = k
+		}
+		sourceRef["kind"] = kind
+	}
+	if len(sourceRef) > 0 {
+		chartSpec["sourceRef"] = sourceRef
+	}
+
+	return map[string]interface{}{
+		"spec": chartSpec,
+	}
+}
+
+// chartSource returns the source of chart with chartVersion applied,
+// or the version of releaseName in versionMap if chart has no chartVersion
+func (p *plugin) chartSource(chart ReplacedChart, releaseName string) ChartSource {
+	source := chart.Source
+	if chart.ChartVersion != "" {
+		source.Version = chart.ChartVersion
+	} else if version := p.VersionMap[releaseName]; version != "" {
+		source.Version = version
+	}
+	return source
+}
+
+// chartGlobals returns the global variables of chart shadowing the top-level ones.
+// chartName and releaseName are the name of HelmRelease, and releaseNamespace is the namespace of it
+// if it has one, unless they are defined explicitly.
+func (p *plugin) chartGlobals(chart ReplacedChart, releaseName, releaseNamespace string) map[string]interface{} {
+	globals := make(map[string]interface{}, len(p.Global)+len(chart.Globals)+3)
+	globals[chartNameVar] = releaseName
+	globals[releaseNameVar] = releaseName
+	if releaseNamespace != "" {
+		globals[releaseNamespaceVar] = releaseNamespace
+	}
+	for name, val := range p.Global {
+		globals[name] = val
+	}
+	for name, val := range chart.Globals {
+		globals[name] = val
+	}
+	return globals
+}
+
+// mergedOverride returns override of replacedChart merged with commonOverride.
+// The values of the chart win over the common ones, and over the existing values in turn.
+func (p *plugin) mergedOverride(replacedChart ReplacedChart) Override {
+	override := Override{}
+	for _, inlinePath := range sortedKeys(p.CommonOverride) {
+		if !isShadowed(inlinePath, replacedChart.Override) {
+			mergeValues(override, Override{inlinePath: p.CommonOverride[inlinePath]})
+		}
+	}
+	mergeValues(override, replacedChart.Override)
+	return override
+}
+
+// isShadowed reports whether a shorter path of override, or the same path with or without the suffix "?",
+// sets the value at inlinePath, which would lose to inlinePath applied after it or conflict with it otherwise
+func isShadowed(inlinePath string, override Override) bool {
+	paths, err := splitOverridePath(strings.TrimSuffix(inlinePath, setIfAbsentSuffix))
+	if err != nil {
+		return false
+	}
+	for otherPath, val := range override {
+		// the same key is merged with mergeValues
+		if otherPath == inlinePath {
+			continue
+		}
+		otherPaths, err := splitOverridePath(strings.TrimSuffix(otherPath, setIfAbsentSuffix))
+		if err != nil || len(otherPaths) > len(paths) || !hasPathPrefix(paths, otherPaths) {
+			continue
+		}
+		// a mapping sets only the keys it has
+		if m, ok := val.(map[string]interface{}); ok {
+			if _, ok = lookupValue(m, paths[len(otherPaths):]); !ok {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (p *plugin) getResourceFromChart(replacedChart ReplacedChart, origin *resource.Resource, globals map[string]interface{}) (r *resource.Resource, err error) {
+	patchMap := map[string]interface{}{}
+	values, err := getMapAt(origin, p.valuesPaths())
+	if err != nil {
+		return nil, err
+	}
+	// rootPatchMap is the patch of the paths starting with "/" from the root of resource
+	rootPatchMap := map[string]interface{}{}
+	originMap, err := origin.Map()
+	if err != nil {
+		return nil, err
+	}
+
+	override := p.mergedOverride(replacedChart)
+	// no patch is made without override, which would add the values to the resource
+	if len(override) == 0 {
+		return nil, nil
+	}
+	if _, isReplace := override[replaceDirective]; isReplace {
+		return p.getReplacedValuesResource(replacedChart, override, globals)
+	}
+	undefinedVars := &undefinedGlobalVarError{}
+	var overridePaths, missingDeletions []overridePath
+	// paths are applied in sorted order to build the same patch every time
+	for _, inlinePath := range sortedKeys(override) {
+		val, err := renderTemplates(replacedChart, override[inlinePath], globals)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid template of override %s of chart %s", inlinePath, replacedChart.Name)
+		}
+		// global variables in the path are replaced before splitting,
+		// so a dot in the value of them splits the path as well
+		resolvedPath, pathErr := p.replaceGlobalVarAt(inlinePath, globals, replacedChart.Name, "override")
+		newVal, err := p.replaceGlobalVarAt(val, globals, replacedChart.Name, "override."+inlinePath)
+		if pathErr != nil || err != nil {
+			for _, e := range []error{pathErr, err} {
+				if e = undefinedVars.collect(e, "", "override."+inlinePath); e != nil {
+					return nil, e
+				}
+			}
+			continue
+		}
+		if newVal == deleteDirective {
+			newVal = deletion{}
+		}
+		if ref, isAlias := aliasRef(newVal); isAlias {
+			newVal = alias{ref}
+		}
+		if newVal, err = p.loadFileValue(newVal); err != nil {
+			return nil, errors.Wrapf(err, "invalid override %s of chart %s", inlinePath, replacedChart.Name)
+		}
+		pathStr := fmt.Sprintf("%v", resolvedPath)
+		setIfAbsent := strings.HasSuffix(pathStr, setIfAbsentSuffix)
+		pathStr = strings.TrimSuffix(pathStr, setIfAbsentSuffix)
+		isRoot := strings.HasPrefix(pathStr, rootPathPrefix)
+		paths, err := splitOverridePath(strings.TrimPrefix(pathStr, rootPathPrefix))
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) > p.maxPathDepth() {
+			return nil, fmt.Errorf("override path %s of chart %s is deeper than maxPathDepth %d", inlinePath, replacedChart.Name, p.maxPathDepth())
+		}
+		var current interface{} = values
+		if isRoot {
+			current = originMap
+		}
+		expanded := [][]string{paths}
+		if containsString(paths, wildcardSegment) {
+			if expanded = expandWildcards(current, paths); len(expanded) == 0 {
+				if p.Strict {
+					return nil, fmt.Errorf("wildcard override path %s of chart %s matches nothing", inlinePath, replacedChart.Name)
+				}
+				p.Logger.with(replacedChart.Name, inlinePath).Debugf("Skipped wildcard override %s of chart %s matching nothing", inlinePath, replacedChart.Name)
+				continue
+			}
+		}
+		for _, paths := range expanded {
+			if _, isDeletion := newVal.(deletion); isDeletion {
+				if _, ok := lookupValue(current, paths); !ok {
+					p.Logger.with(replacedChart.Name, inlinePath).Debugf("Skipped deletion %s of chart %s which does not exist", inlinePath, replacedChart.Name)
+					missingDeletions = append(missingDeletions, overridePath{inlinePath, paths, newVal, isRoot})
+					continue
+				}
+			}
+			if setIfAbsent {
+				if existing, ok := lookupValue(current, paths); ok && existing != nil {
+					p.Logger.with(replacedChart.Name, inlinePath).Debugf("Skipped override %s of chart %s having the value already", inlinePath, replacedChart.Name)
+					continue
+				}
+			}
+			overridePaths = append(overridePaths, overridePath{inlinePath, paths, newVal, isRoot})
+		}
+	}
+	if err = undefinedVars.orNil(); err != nil {
+		return nil, err
+	}
+	// the deletions of missing paths are not applied, but they still conflict with the other paths
+	if err = checkPathConflicts(append(append([]overridePath{}, overridePaths...), missingDeletions...)); err != nil {
+		return nil, errors.Wrapf(err, "invalid override of chart %s", replacedChart.Name)
+	}
+	overridePaths = orderIndexDeletions(overridePaths, values, originMap)
+
+	applyPath := func(path overridePath) error {
+		target, current := patchMap, values
+		if path.root {
+			target, current = rootPatchMap, originMap
+		}
+		if p.WarnNoop {
+			if currentVal, ok := lookupValue(current, path.paths); ok && path.val != (deletion{}) && equalValues(currentVal, path.val) {
+				p.Logger.with(replacedChart.Name, path.inlinePath).Warnf("Override %s of chart %s does not change the value", path.inlinePath, replacedChart.Name)
+			}
+		}
+		if _, err := p.createMapFromPaths(target, current, path.paths, path.val); err != nil {
+			return errors.Wrapf(err, "invalid override path %s of chart %s", path.inlinePath, replacedChart.Name)
+		}
+		p.stats.Paths++
+		return nil
+	}
+	var aliases []overridePath
+	for _, path := range overridePaths {
+		if _, isAlias := path.val.(alias); isAlias {
+			aliases = append(aliases, path)
+			continue
+		}
+		if err = applyPath(path); err != nil {
+			return nil, err
+		}
+	}
+	// aliases copy the values of the other paths applied already,
+	// and an alias waits for the aliases inside the path it refers to be resolved
+	for len(aliases) > 0 {
+		var unresolved []overridePath
+		for i, path := range aliases {
+			ref := path.val.(alias).ref
+			refPatchMap, isRoot := patchMap, strings.HasPrefix(ref, rootPathPrefix)
+			if isRoot {
+				refPatchMap = rootPatchMap
+			}
+			refPaths, err := splitOverridePath(strings.TrimPrefix(ref, rootPathPrefix))
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid $ref of override %s of chart %s", path.inlinePath, replacedChart.Name)
+			}
+			isPending := false
+			for _, pending := range [][]overridePath{unresolved, aliases[i+1:]} {
+				for _, other := range pending {
+					isPending = isPending || (other.root == isRoot && hasPathPrefix(other.paths, refPaths))
+				}
+			}
+			val, ok := lookupValue(refPatchMap, refPaths)
+			if isPending || !ok || val == nil {
+				unresolved = append(unresolved, path)
+				continue
+			}
+			path.val = deepCopyValue(val)
+			if err = applyPath(path); err != nil {
+				return nil, err
+			}
+		}
+		if len(unresolved) == len(aliases) {
+			return nil, fmt.Errorf("$ref %s of override %s of chart %s does not exist", unresolved[0].val.(alias).ref, unresolved[0].inlinePath, replacedChart.Name)
+		}
+		aliases = unresolved
+	}
+	if replacedChart.ValuesSchema != "" {
+		if err = p.validateValues(patchMap, replacedChart.ValuesSchema); err != nil {
+			return nil, errors.Wrapf(err, "invalid override of chart %s", replacedChart.Name)
+		}
+	}
+
+	resourceMap := nestMap(p.valuesPaths(), patchMap)
+	mergeValues(rootPatchMap, resourceMap)
+	resource := p.h.ResmapFactory().RF().FromMap(rootPatchMap)
+	return resource, nil
+}
+
+// alias is the value of override copied from the other override path ref, i.e. {$ref: ingress.host}
+type alias struct {
+	ref string
+}
+
+// aliasRef returns ref of val if val is a mapping of $ref only
+func aliasRef(val interface{}) (string, bool) {
+	m, ok := val.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		return "", false
+	}
+	ref, ok := m[refDirective].(string)
+	return ref, ok
+}
+
+// loadFileValue returns the content of file if val is a mapping of $file only,
+// or the content parsed as yaml if val is a mapping of $fileYaml only. Otherwise val is returned as it is.
+func (p *plugin) loadFileValue(val interface{}) (interface{}, error) {
+	m, ok := val.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		return val, nil
+	}
+	directive := fileDirective
+	path, ok := m[directive]
+	if !ok {
+		directive = fileYamlDirective
+		if path, ok = m[directive]; !ok {
+			return val, nil
+		}
+	}
+	pathStr, ok := path.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a path: %v", directive, path)
+	}
+	content, err := p.loadFile(pathStr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can not read %s %s", directive, pathStr)
+	}
+	if directive == fileDirective {
+		return string(content), nil
+	}
+	// the documents are merged in order as the files of globalsFrom
+	if isMultiDocument(content) {
+		merged, err := unmarshalDocuments(content)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can not parse %s %s, whose documents must be mappings", directive, pathStr)
+		}
+		return merged, nil
+	}
+	var parsed interface{}
+	if err = yaml.Unmarshal(content, &parsed); err != nil {
+		return nil, errors.Wrapf(err, "can not parse %s %s", directive, pathStr)
+	}
+	return parsed, nil
+}
+
+// overridePath is an override path split into the segments with the value of it resolved
+type overridePath struct {
+	inlinePath string
+	paths      []string
+	val        interface{}
+	// root is true if paths start from the root of resource instead of the values
+	root bool
+}
+
+// checkPathConflicts fails if a path is the same as another, or a prefix of another
+// while the value of it is neither a map nor a list which the longer path can go into.
+func checkPathConflicts(overridePaths []overridePath) error {
+	for i, a := range overridePaths {
+		for _, b := range overridePaths[i+1:] {
+			if a.root != b.root {
+				continue
+			}
+			shorter, longer := a, b
+			if len(shorter.paths) > len(longer.paths) {
+				shorter, longer = longer, shorter
+			}
+			if !hasPathPrefix(longer.paths, shorter.paths) {
+				continue
+			}
+			switch shorter.val.(type) {
+			case map[string]interface{}, []interface{}:
+				if len(shorter.paths) < len(longer.paths) {
+					continue
+				}
+			}
+			return fmt.Errorf("override paths %s and %s conflict", shorter.inlinePath, longer.inlinePath)
+		}
+	}
+	return nil
+}
+
+// getValuesFromResource returns the patch appending valuesFrom of replacedChart to spec.valuesFrom of origin,
+// or nil if replacedChart has no valuesFrom. The entries origin already has are not appended again.
+func (p *plugin) getValuesFromResource(replacedChart ReplacedChart, origin *resource.Resource, globals map[string]interface{}) (*resource.Resource, error) {
+	if len(replacedChart.ValuesFrom) == 0 {
+		return nil, nil
+	}
+	resourceMap, err := origin.Map()
+	if err != nil {
+		return nil, err
+	}
+	spec, _ := resourceMap["spec"].(map[string]interface{})
+	valuesFrom, ok := spec["valuesFrom"].([]interface{})
+	if spec["valuesFrom"] != nil && !ok {
+		return nil, fmt.Errorf("spec.valuesFrom is not a list in %s %s", origin.GetKind(), origin.GetName())
+	}
+
+	undefinedVars := &undefinedGlobalVarError{}
+	for i, ref := range replacedChart.ValuesFrom {
+		name, err := p.replaceGlobalVarAt(ref.Name, globals, replacedChart.Name, fmt.Sprintf("valuesFrom.%d.name", i))
+		if err != nil {
+			if err = undefinedVars.collect(err, "", fmt.Sprintf("valuesFrom.%d.name", i)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		ref.Name = fmt.Sprintf("%v", name)
+		entry, err := toValuesFromEntry(ref, origin.GetGvk())
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid valuesFrom of chart %s", replacedChart.Name)
+		}
+		if !containsValue(valuesFrom, entry) {
+			valuesFrom = append(valuesFrom, entry)
+		}
+	}
+	if err = undefinedVars.orNil(); err != nil {
+		return nil, err
+	}
+
+	return p.h.ResmapFactory().RF().FromMap(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"valuesFrom": valuesFrom,
+		},
+	}), nil
+}
+
+// toValuesFromEntry converts ref to the entry of spec.valuesFrom of HelmRelease of gvk.
+// Flux v1 refers the values with configMapKeyRef or secretKeyRef instead of kind.
+func toValuesFromEntry(ref ValuesReference, gvk resid.Gvk) (map[string]interface{}, error) {
+	if ref.Kind != "ConfigMap" && ref.Kind != "Secret" {
+		return nil, fmt.Errorf("kind of valuesFrom %s is not ConfigMap nor Secret", ref.Name)
+	}
+	entry := map[string]interface{}{"name": ref.Name}
+	if isFluxV2(gvk) {
+		entry["kind"] = ref.Kind
+		if ref.ValuesKey != "" {
+			entry["valuesKey"] = ref.ValuesKey
+		}
+		if ref.Optional {
+			entry["optional"] = true
+		}
+		return entry, nil
+	}
+
+	if ref.ValuesKey != "" {
+		entry["key"] = ref.ValuesKey
+	}
+	if ref.Optional {
+		entry["optional"] = true
+	}
+	if ref.Kind == "ConfigMap" {
+		return map[string]interface{}{"configMapKeyRef": entry}, nil
+	}
+	return map[string]interface{}{"secretKeyRef": entry}, nil
+}
+
+// containsValue reports whether list has an item deeply equal to val
+func containsValue(list []interface{}, val interface{}) bool {
+	for _, item := range list {
+		if equalValues(item, val) {
+			return true
+		}
+	}
+	return false
+}
+
+// templateFuncs are the functions of the templates, which are the functions of global variables,
+// i.e. {{ upper .env }}, with replace, default and quote
+var templateFuncs = newTemplateFuncs()
+
+func newTemplateFuncs() template.FuncMap {
+	funcs := template.FuncMap{
+		// replace, default and quote take the arguments in the same order as sprig
+		"replace": func(old, new string, val interface{}) string {
+			return strings.ReplaceAll(formatScalar(val), old, new)
+		},
+		"default": func(def, val interface{}) interface{} {
+			if val == nil || val == "" {
+				return def
+			}
+			return val
+		},
+		"quote": func(val interface{}) string {
+			return strconv.Quote(formatScalar(val))
+		},
+	}
+	for _, name := range []string{"int", "float", "bool", "string", "upper", "lower", "trim", "b64enc", "b64dec"} {
+		name := name
+		funcs[name] = func(val interface{}) (interface{}, error) {
+			return applyGlobalVarFunc(val, name)
+		}
+	}
+	return funcs
+}
+
+// renderTemplates renders the strings having "{{" in val as Go templates with globals as the data
+// if chart has goTemplate. The missing keys of globals are an error, and the result is always a string.
+// Nil globals leave val verbatim for the chart with rawValues.
+func renderTemplates(chart ReplacedChart, val interface{}, globals map[string]interface{}) (interface{}, error) {
+	if !chart.GoTemplate || globals == nil {
+		return val, nil
+	}
+	switch v := val.(type) {
+	case string:
+		if !strings.Contains(v, "{{") {
+			return v, nil
+		}
+		tmpl, err := template.New(chart.Name).Option("missingkey=error").Funcs(templateFuncs).Parse(v)
+		if err != nil {
+			return nil, err
+		}
+		var rendered strings.Builder
+		if err = tmpl.Execute(&rendered, globals); err != nil {
+			return nil, err
+		}
+		return rendered.String(), nil
+	case map[string]interface{}:
+		rendered := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			renderedItem, err := renderTemplates(chart, item, globals)
+			if err != nil {
+				return nil, err
+			}
+			rendered[key] = renderedItem
+		}
+		return rendered, nil
+	case []interface{}:
+		rendered := make([]interface{}, len(v))
+		for i, item := range v {
+			renderedItem, err := renderTemplates(chart, item, globals)
+			if err != nil {
+				return nil, err
+			}
+			rendered[i] = renderedItem
+		}
+		return rendered, nil
+	}
+	return val, nil
+}
+
+// getReplacedValuesResource returns the patch replacing the whole spec.values with the value of $replace in override
+func (p *plugin) getReplacedValuesResource(replacedChart ReplacedChart, override Override, globals map[string]interface{}) (*resource.Resource, error) {
+	if len(override) > 1 {
+		return nil, fmt.Errorf("override of chart %s can not have the other paths with %s", replacedChart.Name, replaceDirective)
+	}
+	val, err := renderTemplates(replacedChart, override[replaceDirective], globals)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid template of override %s of chart %s", replaceDirective, replacedChart.Name)
+	}
+	val, err = p.replaceGlobalVarAt(val, globals, replacedChart.Name, "override."+replaceDirective)
+	if err != nil {
+		undefinedVars := &undefinedGlobalVarError{}
+		if err = undefinedVars.collect(err, "", "override."+replaceDirective); err != nil {
+			return nil, err
+		}
+		return nil, undefinedVars
+	}
+	values, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s of chart %s is not a mapping", replaceDirective, replacedChart.Name)
+	}
+	if replacedChart.ValuesSchema != "" {
+		if err = p.validateValues(values, replacedChart.ValuesSchema); err != nil {
+			return nil, errors.Wrapf(err, "invalid override of chart %s", replacedChart.Name)
+		}
+	}
+
+	patchMap := deepCopyValue(values).(map[string]interface{})
+	patchMap[patchDirective] = "replace"
+	return p.h.ResmapFactory().RF().FromMap(nestMap(p.valuesPaths(), patchMap)), nil
+}
+
+// validateValues validates values against JSON schema file at schemaPath
+func (p *plugin) validateValues(values map[string]interface{}, schemaPath string) (err error) {
+	content, err := p.loadFile(schemaPath)
+	if err != nil {
+		return err
+	}
+	schemaJSON, err := yaml.YAMLToJSON(content)
+	if err != nil {
+		return errors.Wrapf(err, "invalid valuesSchema %s", schemaPath)
+	}
+	schema := &spec.Schema{}
+	if err = json.Unmarshal(schemaJSON, schema); err != nil {
+		return errors.Wrapf(err, "invalid valuesSchema %s", schemaPath)
+	}
+
+	// the validator panics on the schema it does not support, i.e. $ref
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("unsupported valuesSchema %s: %v", schemaPath, r)
+		}
+	}()
+	return validate.AgainstSchema(schema, values, strfmt.Default)
+}
+
+// getSpecMap returns spec.<field> of resource, or nil if it is absent.
+// It fails if spec or spec.<field> is not a mapping.
+func getSpecMap(resource *resource.Resource, field string) (map[string]interface{}, error) {
+	return getMapAt(resource, []string{"spec", field})
+}
+
+// getMapAt returns the mapping at paths of resource, or nil if it is absent or null.
+// It fails if any of the values on paths is not a mapping.
+func getMapAt(resource *resource.Resource, paths []string) (map[string]interface{}, error) {
+	resourceMap, err := resource.Map()
+	if err != nil {
+		return nil, err
+	}
+	for i, path := range paths {
+		if resourceMap[path] == nil {
+			return nil, nil
+		}
+		fieldMap, ok := resourceMap[path].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s is not a mapping in %s %s", strings.Join(paths[:i+1], "."), resource.GetKind(), resource.GetName())
+		}
+		resourceMap = fieldMap
+	}
+	return resourceMap, nil
+}
+
+// setMapAt sets the mapping at paths of resource to val, keeping the order and the comments
+// of the fields which are not changed
+func setMapAt(resource *resource.Resource, paths []string, val map[string]interface{}) error {
+	current, err := resource.Pipe(kyaml.Lookup(paths...))
+	if err != nil {
+		return err
+	}
+	var node *kyaml.Node
+	if current != nil {
+		node = current.YNode()
+	}
+	node, err = syncNode(node, val)
+	if err != nil {
+		return err
+	}
+	return resource.SetMapField(kyaml.NewRNode(node), paths...)
+}
+
+// syncNode returns node updated to val. The fields of a mapping keep their order, and new ones
+// are appended in sorted order. The nodes of the unchanged scalars are kept as they are,
+// and a replaced node takes over the comments of the old one.
+func syncNode(node *kyaml.Node, val interface{}) (*kyaml.Node, error) {
+	if node != nil && node.Kind == kyaml.MappingNode {
+		if m, ok := val.(map[string]interface{}); ok {
+			var content []*kyaml.Node
+			synced := map[string]bool{}
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key := node.Content[i].Value
+				v, ok := m[key]
+				if !ok {
+					continue
+				}
+				valueNode, err := syncNode(node.Content[i+1], v)
+				if err != nil {
+					return nil, err
+				}
+				content = append(content, node.Content[i], valueNode)
+				synced[key] = true
+			}
+			var keys []string
+			for key := range m {
+				if !synced[key] {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				valueNode, err := syncNode(nil, m[key])
+				if err != nil {
+					return nil, err
+				}
+				content = append(content, kyaml.NewStringRNode(key).YNode(), valueNode)
+			}
+			if len(node.Content) == 0 {
+				// an empty flow mapping, i.e. {}, is filled in block style
+				node.Style = 0
+			}
+			node.Content = content
+			return node, nil
+		}
+	}
+	if node != nil && node.Kind == kyaml.SequenceNode {
+		if l, ok := val.([]interface{}); ok && len(l) == len(node.Content) {
+			for i, item := range l {
+				itemNode, err := syncNode(node.Content[i], item)
+				if err != nil {
+					return nil, err
+				}
+				node.Content[i] = itemNode
+			}
+			return node, nil
+		}
+	}
+	newNode := &kyaml.Node{}
+	if err := newNode.Encode(val); err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return newNode, nil
+	}
+	if node.Kind == kyaml.ScalarNode && newNode.Kind == kyaml.ScalarNode && node.Value == newNode.Value && node.ShortTag() == newNode.ShortTag() {
+		return node, nil
+	}
+	newNode.HeadComment = node.HeadComment
+	newNode.LineComment = node.LineComment
+	newNode.FootComment = node.FootComment
+	return newNode, nil
+}
+
+// nestMap returns val nested in the mappings at paths
+func nestMap(paths []string, val interface{}) map[string]interface{} {
+	for i := len(paths) - 1; i > 0; i-- {
+		val = map[string]interface{}{paths[i]: val}
+	}
+	return map[string]interface{}{paths[0]: val}
+}
+
+// valuesPaths returns the path of values in the resource, which is spec.values by default
+func (p *plugin) valuesPaths() []string {
+	if p.ValuesPath == "" {
+		return []string{"spec", "values"}
+	}
+	paths, _ := splitOverridePath(p.ValuesPath)
+	return paths
+}
+
+// defaultMaxPathDepth is the maximum number of segments of an override path unless maxPathDepth is set
+const defaultMaxPathDepth = 64
+
+// maxPathDepth returns the maximum number of segments of an override path
+func (p *plugin) maxPathDepth() int {
+	if p.MaxPathDepth == 0 {
+		return defaultMaxPathDepth
+	}
+	return p.MaxPathDepth
+}
+
+// inlinePath is a path string using json dot notation
+// i.e. "conf.ceph.admin_keyring" or "containers.0.resources.limits.cpu"
+// current is the values the resource already has at the same level as chart.
+func (p *plugin) createMapFromPaths(chart map[string]interface{}, current map[string]interface{}, paths []string, val interface{}) (map[string]interface{}, error) {
+	node, err := p.createValueFromPaths(chart, current, paths, val)
+	if err != nil {
+		return nil, err
+	}
+	return node.(map[string]interface{}), nil
+}
+
+// createValueFromPaths sets val at paths of node and returns the node.
+// A numeric path segment indexes into a list if node or current is a list, or it is a key of a mapping.
+// An index in brackets, i.e. "[0]", always indexes into a list, which is padded with nil up to the index.
+// The last segment "[]" appends the items of val to the list,
+// and the last segment of the merge key, i.e. "(name)", merges them by the key.
+// The list is copied from current when node has no list yet,
+// because a list in the patch replaces the whole list of the resource.
+func (p *plugin) createValueFromPaths(node interface{}, current interface{}, paths []string, val interface{}) (interface{}, error) {
+	if len(paths) == 0 {
+		// null removes the key in the patch
+		if _, isDeletion := val.(deletion); isDeletion {
+			return nil, nil
+		}
+		return val, nil
+	}
+	currentPath := paths[0]
+
+	if currentPath == appendSegment {
+		if len(paths) > 1 {
+			return nil, errors.New("[] must be at the end of path")
+		}
+		if node == nil {
+			node = current
+			if node == nil {
+				node = []interface{}{}
+			}
+			node = deepCopyValue(node)
+		}
+		list, ok := node.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("can not append to %T", node)
+		}
+		items, ok := val.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("can not append %T to list", val)
+		}
+		return append(list, deepCopyValue(items).([]interface{})...), nil
+	}
+
+	if mergeKey, isMergeKey := parseMergeKey(currentPath); isMergeKey {
+		if len(paths) > 1 {
+			return nil, fmt.Errorf("%s must be at the end of path", currentPath)
+		}
+		if node == nil {
+			node = current
+			if node == nil {
+				node = []interface{}{}
+			}
+			node = deepCopyValue(node)
+		}
+		list, ok := node.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("can not merge by %s into %T", mergeKey, node)
+		}
+		items, ok := val.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("can not merge %T into list by %s", val, mergeKey)
+		}
+		return mergeListByKey(list, items, mergeKey)
+	}
+
+	if index, isIndex := parseIndex(currentPath); isIndex && (isIndexSegment(currentPath) || isList(node) || node == nil && isList(current)) {
+		if node == nil {
+			node = current
+			if node == nil {
+				node = []interface{}{}
+			}
+			node = deepCopyValue(node)
+		}
+		list, ok := node.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("can not index %s into %T", currentPath, node)
+		}
+		// a negative index counts from the end of list
+		if index < 0 {
+			if -index > len(list) {
+				return nil, fmt.Errorf("index %s is out of range of list of %d items", currentPath, len(list))
+			}
+			index += len(list)
+		}
+		if _, isDeletion := val.(deletion); isDeletion {
+			if index >= len(list) {
+				return list, nil
+			}
+			if len(paths) == 1 {
+				return append(list[:index], list[index+1:]...), nil
+			}
+			// the list replaces the whole list of the resource, so null would be kept in the item
+			list[index], _ = removeValue(list[index], paths[1:])
+			return list, nil
+		}
+		for len(list) <= index {
+			list = append(list, nil)
+		}
+		var currentItem interface{}
+		if currentList, ok := current.([]interface{}); ok && index < len(currentList) {
+			currentItem = currentList[index]
+		}
+		item, err := p.createValueFromPaths(list[index], currentItem, paths[1:], val)
+		if err != nil {
+			return nil, err
+		}
+		list[index] = item
+		return list, nil
+	}
+
+	if node == nil {
+		// a mapping in the patch can not be merged into the other kinds of value
+		if _, isMap := current.(map[string]interface{}); current != nil && !isMap {
+			return nil, fmt.Errorf("can not set %s into %T", currentPath, current)
+		}
+		node = map[string]interface{}{}
+	}
+	chart, ok := node.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("can not set %s into %T", currentPath, node)
+	}
+	currentMap, _ := current.(map[string]interface{})
+	child, err := p.createValueFromPaths(chart[currentPath], currentMap[currentPath], paths[1:], val)
+	if err != nil {
+		return nil, err
+	}
+	chart[currentPath] = child
+	return chart, nil
+}
+
+// orderIndexDeletions moves the deletions of list items after the other paths, the deeper paths and
+// the higher indices first, because removing an item shifts the indices of the items after it
+func orderIndexDeletions(paths []overridePath, values, originMap map[string]interface{}) []overridePath {
+	type indexDeletion struct {
+		path  overridePath
+		index int
+	}
+	var ordered []overridePath
+	var deletions []indexDeletion
+	for _, path := range paths {
+		path, index, isIndexDeletion := deletedIndex(path, values, originMap)
+		if !isIndexDeletion {
+			ordered = append(ordered, path)
+			continue
+		}
+		deletions = append(deletions, indexDeletion{path, index})
+	}
+	sort.SliceStable(deletions, func(i, j int) bool {
+		if len(deletions[i].path.paths) != len(deletions[j].path.paths) {
+			return len(deletions[i].path.paths) > len(deletions[j].path.paths)
+		}
+		return deletions[i].index > deletions[j].index
+	})
+	for _, d := range deletions {
+		ordered = append(ordered, d.path)
+	}
+	return ordered
+}
+
+// deletedIndex returns path with the index of the list item it deletes counted from the start of list,
+// the index and whether path deletes a list item
+func deletedIndex(path overridePath, values, originMap map[string]interface{}) (overridePath, int, bool) {
+	if _, isDeletion := path.val.(deletion); !isDeletion {
+		return path, 0, false
+	}
+	current := values
+	if path.root {
+		current = originMap
+	}
+	paths, index, isIndex := listIndex(current, path.paths)
+	path.paths = paths
+	return path, index, isIndex
+}
+
+// listIndex returns paths with the last segment counted from the start of list if it indexes into a list of current,
+// the index and whether it does
+func listIndex(current interface{}, paths []string) ([]string, int, bool) {
+	last := len(paths) - 1
+	index, isIndex := parseIndex(paths[last])
+	if !isIndex {
+		return paths, 0, false
+	}
+	parent, _ := lookupValue(current, paths[:last])
+	list, isList := parent.([]interface{})
+	if !isList {
+		return paths, 0, false
+	}
+	if index < 0 {
+		index += len(list)
+		segment := strconv.Itoa(index)
+		if isIndexSegment(paths[last]) {
+			segment = "[" + segment + "]"
+		}
+		paths = append(append([]string{}, paths[:last]...), segment)
+	}
+	return paths, index, true
+}
+
+// expandWildcards returns the paths replacing each wildcard segment of paths with the keys of
+// the mapping or the indices of the list at it in current, in sorted order of the keys.
+// The deletions of the list items expanded are applied from the last by orderIndexDeletions.
+func expandWildcards(current interface{}, paths []string) [][]string {
+	for i, path := range paths {
+		if path != wildcardSegment {
+			continue
+		}
+		parent, ok := lookupValue(current, paths[:i])
+		if !ok {
+			return nil
+		}
+		var keys []string
+		switch v := parent.(type) {
+		case map[string]interface{}:
+			keys = sortedKeys(v)
+		case []interface{}:
+			for j := range v {
+				keys = append(keys, strconv.Itoa(j))
+			}
+		}
+		var expanded [][]string
+		for _, key := range keys {
+			concrete := append(append(append([]string{}, paths[:i]...), key), paths[i+1:]...)
+			expanded = append(expanded, expandWildcards(current, concrete)...)
+		}
+		return expanded
+	}
+	return [][]string{paths}
+}
+
+// lookupValue returns the value at paths of current, and whether it exists
+func lookupValue(current interface{}, paths []string) (interface{}, bool) {
+	for _, path := range paths {
+		switch v := current.(type) {
+		case map[string]interface{}:
+			val, ok := v[path]
+			if !ok {
+				return nil, false
+			}
+			current = val
+		case []interface{}:
+			index, isIndex := parseIndex(path)
+			if index < 0 {
+				index += len(v)
+			}
+			if !isIndex || index < 0 || index >= len(v) {
+				return nil, false
+			}
+			current = v[index]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// equalValues reports whether a and b are the same as json, which ignores the types of numbers
+func equalValues(a, b interface{}) bool {
+	aJSON, errA := json.Marshal(a)
+	bJSON, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(aJSON, bJSON)
+}
+
+// parseMergeKey returns the merge key of the path segment in parentheses, i.e. "(name)"
+func parseMergeKey(path string) (string, bool) {
+	if len(path) > 2 && strings.HasPrefix(path, "(") && strings.HasSuffix(path, ")") {
+		return path[1 : len(path)-1], true
+	}
+	return "", false
+}
+
+// mergeListByKey merges the items into the item of list having the same value of key,
+// and appends the items which list does not have.
+func mergeListByKey(list, items []interface{}, key string) ([]interface{}, error) {
+	for _, item := range items {
+		itemMap, ok := item.(map[string]interface{})
+		if !ok || itemMap[key] == nil {
+			return nil, fmt.Errorf("item to merge by %s has no %s: %v", key, key, item)
+		}
+		merged := false
+		for i, existing := range list {
+			existingMap, ok := existing.(map[string]interface{})
+			if ok && equalValues(existingMap[key], itemMap[key]) {
+				mergePatchValues(existingMap, itemMap)
+				list[i] = existingMap
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			list = append(list, deepCopyValue(itemMap))
+		}
+	}
+	return list, nil
+}
+
+// parseIndex returns the list index of a numeric path segment or an index in brackets, i.e. "[0]".
+// A negative index, i.e. "-1", counts from the end of list.
+func parseIndex(path string) (int, bool) {
+	if isIndexSegment(path) {
+		path = path[1 : len(path)-1]
+	}
+	digits := strings.TrimPrefix(path, "-")
+	if digits == "" || digits == "0" && digits != path {
+		return 0, false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	index, err := strconv.Atoi(path)
+	return index, err == nil
+}
+
+// isIndexSegment reports whether path is an index in brackets, i.e. "[0]", which always indexes into a list
+func isIndexSegment(path string) bool {
+	return len(path) > 2 && strings.HasPrefix(path, "[") && strings.HasSuffix(path, "]")
+}
+
+func isList(val interface{}) bool {
+	_, ok := val.([]interface{})
+	return ok
+}
+
+// mergeValues deep-merges src into dst. The values of src win except both are mappings.
+func mergeValues(dst, src map[string]interface{}) {
+	for key, srcVal := range src {
+		dstMap, isDstMap := dst[key].(map[string]interface{})
+		srcMap, isSrcMap := srcVal.(map[string]interface{})
+		if isDstMap && isSrcMap {
+			mergeValues(dstMap, srcMap)
+			continue
+		}
+		dst[key] = deepCopyValue(srcVal)
+	}
+}
+
+// mergePatchValues is mergeValues, but null in src removes the key from dst like strategic merge patch
+func mergePatchValues(dst, src map[string]interface{}) {
+	for key, srcVal := range src {
+		if srcVal == nil {
+			delete(dst, key)
+			continue
+		}
+		dstMap, isDstMap := dst[key].(map[string]interface{})
+		srcMap, isSrcMap := srcVal.(map[string]interface{})
+		if isDstMap && isSrcMap {
+			mergePatchValues(dstMap, srcMap)
+			continue
+		}
+		dst[key] = deepCopyValue(srcVal)
+	}
+}
+
+// containsString reports whether list has str
+func containsString(list []string, str string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedKeys returns the keys of m in sorted order
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// deepCopyValue copies the maps and lists nested in val.
+func deepCopyValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			copied[key] = deepCopyValue(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = deepCopyValue(item)
+		}
+		return copied
+	}
+	return val
+}
+
+// globalsOptions are the options of resolving global variables as the fields of the plugin with the same names
+type globalsOptions struct {
+	// AllowEnv falls back to the environment variables for undefined global variables
+	AllowEnv bool
+	// OnUndefined is one of error, keep and empty (default error)
+	OnUndefined string
+	// EmptyAsDefault falls back to the default of $(name:-default) for the global variable of an empty string as well
+	EmptyAsDefault bool
+}
+
+// ResolveGlobals replaces the global variables in value with globals as the override of a chart does.
+// The undefined global variables are an error, and neither environment variables nor the other charts are referred.
+func ResolveGlobals(value interface{}, globals map[string]interface{}) (interface{}, error) {
+	return ResolveGlobalsWith(value, globals, false, "", false)
+}
+
+// ResolveGlobalsWith is ResolveGlobals with allowEnvGlobals, onUndefinedGlobal and emptyAsDefault of the plugin.
+// The other charts are not referred without the plugin.
+func ResolveGlobalsWith(value interface{}, globals map[string]interface{}, allowEnv bool, onUndefined string, emptyAsDefault bool) (interface{}, error) {
+	logger, _ := newLeveledLogger("silent", "", io.Discard)
+	if globals == nil {
+		globals = map[string]interface{}{}
+	}
+	r := &globalsResolver{
+		globalsOptions: globalsOptions{AllowEnv: allowEnv, OnUndefined: onUndefined, EmptyAsDefault: emptyAsDefault},
+		logger:         logger,
+	}
+	return r.replaceGlobalVarWith(value, globals, nil)
+}
+
+// globalsResolver replaces the global variables independently of the plugin
+type globalsResolver struct {
+	globalsOptions
+	logger *leveledLogger
+	// chartRef resolves a reference to the override of another chart, or nil to leave it undefined
+	chartRef func(ref string, resolving []string) (interface{}, error)
+	// substituted counts a global variable substituted, or nil not to count
+	substituted func(resolving []string)
+}
+
+// resolveChartRef resolves a reference to the override of another chart with chartRef
+func (r *globalsResolver) resolveChartRef(ref string, resolving []string) (interface{}, error) {
+	if r.chartRef == nil {
+		return nil, &undefinedGlobalVarError{refs: []globalVarRef{{name: ref}}}
+	}
+	return r.chartRef(ref, resolving)
+}
+
+// countSubstitution counts a global variable substituted with substituted
+func (r *globalsResolver) countSubstitution(resolving []string) {
+	if r.substituted != nil {
+		r.substituted(resolving)
+	}
+}
+
+// globalsResolver returns the resolver with the options of the plugin referring to the charts of it
+func (p *plugin) globalsResolver() *globalsResolver {
+	return &globalsResolver{
+		globalsOptions: globalsOptions{
+			AllowEnv:       p.AllowEnvGlobals,
+			OnUndefined:    p.OnUndefinedGlobal,
+			EmptyAsDefault: p.EmptyAsDefault,
+		},
+		logger:      p.Logger,
+		chartRef:    p.resolveChartRef,
+		substituted: p.countSubstitution,
+	}
+}
+
+// replaceGlobalVar replaces the variables in original with globals
+func (p *plugin) replaceGlobalVar(original interface{}, globals map[string]interface{}) (interface{}, error) {
+	return p.replaceGlobalVarWith(original, globals, nil)
+}
+
+// replaceGlobalVarWith replaces the variables in original with globals and the charts of the plugin.
+// resolving is the chain of global variables being resolved to detect a cycle.
+func (p *plugin) replaceGlobalVarWith(original interface{}, globals map[string]interface{}, resolving []string) (interface{}, error) {
+	return p.globalsResolver().replaceGlobalVarWith(original, globals, resolving)
+}
+
+// replaceGlobalVarAt replaces the variables in original with globals,
+// and logs the value at path of chart before and after the replacement at trace level.
+func (p *plugin) replaceGlobalVarAt(original interface{}, globals map[string]interface{}, chart, path string) (interface{}, error) {
+	replaced, err := p.replaceGlobalVar(original, globals)
+	if err == nil && !reflect.DeepEqual(original, replaced) {
+		p.Logger.with(chart, path).Tracef("chart %s path %s: %v -> %v", chart, path, original, replaced)
+	}
+	return replaced, err
+}
+
+// replaceGlobalVarWith replaces the variables in original with globals.
+// The maps and lists are replaced recursively including the keys of maps.
+// resolving is the chain of global variables being resolved to detect a cycle.
+// nil globals leave original verbatim for the chart with rawValues.
+func (r *globalsResolver) replaceGlobalVarWith(original interface{}, globals map[string]interface{}, resolving []string) (interface{}, error) {
+	if globals == nil {
+		return deepCopyValue(original), nil
+	}
+	// undefined global variables are reported together
+	undefinedVars := &undefinedGlobalVarError{}
+	switch v := original.(type) {
+	case string:
+		return r.replaceGlobalVarInString(v, globals, resolving)
+	case map[string]interface{}:
+		replaced := make(map[string]interface{}, len(v))
+		for _, key := range sortedKeys(v) {
+			newKey, err := r.replaceGlobalVarInString(key, globals, resolving)
+			if err == nil {
+				newKey, err = interpolate(key, newKey)
+			}
+			newVal, valErr := r.replaceGlobalVarWith(v[key], globals, resolving)
+			if err != nil || valErr != nil {
+				for _, e := range []error{err, valErr} {
+					if e = undefinedVars.collect(e, "", ""); e != nil {
+						return nil, e
+					}
+				}
+				continue
+			}
+			replaced[newKey.(string)] = newVal
+		}
+		if err := undefinedVars.orNil(); err != nil {
+			return nil, err
+		}
+		return replaced, nil
+	case []interface{}:
+		replaced := make([]interface{}, len(v))
+		for i, item := range v {
+			newItem, err := r.replaceGlobalVarWith(item, globals, resolving)
+			if err != nil {
+				if err = undefinedVars.collect(err, "", ""); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			replaced[i] = newItem
+		}
+		if err := undefinedVars.orNil(); err != nil {
+			return nil, err
+		}
+		return replaced, nil
+	}
+	return original, nil
+}
+
+// findGlobalVars returns the index pairs of the references to global variable in str, i.e. "$(name)".
+// The parentheses in a reference are balanced, i.e. "$(tag|regexReplace:^v([0-9]+).*:$1)",
+// and a reference can have other references in it, i.e. "$(a:-$(b))".
+// "$((" is not a reference, which keeps the arithmetic of shell, i.e. "$((1+2))", as it is.
+func findGlobalVars(str string) [][]int {
+	var matches [][]int
+	for start := 0; start < len(str)-1; {
+		i := strings.Index(str[start:], "$(")
+		if i < 0 {
+			break
+		}
+		begin, end, depth := start+i, -1, 0
+		if isShellArithmetic(str, begin+1) {
+			start = begin + 2
+			continue
+		}
+		for j := begin + 2; j < len(str) && end < 0; j++ {
+			switch {
+			case str[j] == '(':
+				depth++
+			case str[j] == ')' && depth > 0:
+				depth--
+			case str[j] == ')':
+				end = j + 1
+			}
+		}
+		if end < 0 {
+			// the references in an unterminated one are matched
+			start = begin + 2
+			continue
+		}
+		if end-begin > 3 {
+			matches = append(matches, []int{begin, end})
+		}
+		start = end
+	}
+	return matches
+}
+
+// isShellArithmetic reports whether the parenthesis at i of str starts "$((", i.e. "$((1+2))"
+func isShellArithmetic(str string, i int) bool {
+	return i+1 < len(str) && str[i+1] == '('
+}
+
+// replaceGlobalVarInString replaces the variables in inlineStr with globals
+func (r *globalsResolver) replaceGlobalVarInString(inlineStr string, globals map[string]interface{}, resolving []string) (interface{}, error) {
+	// no global variable
+	if !strings.Contains(inlineStr, "$(") {
+		return inlineStr, nil
+	}
+	// "$$(" is an escaped literal "$(", hide it from the matches
+	isEscaped := strings.Contains(inlineStr, "$$(")
+	if isEscaped {
+		inlineStr = strings.ReplaceAll(inlineStr, "$$(", escapedVarPrefix)
+	}
+	matches := findGlobalVars(inlineStr)
+	if len(matches) == 0 && !isEscaped {
+		return inlineStr, nil
+	}
+
+	// keep the type of global variable if it is the whole value
+	if len(matches) == 1 && matches[0][0] == 0 && matches[0][1] == len(inlineStr) {
+		val, err := r.lookupGlobalVarRef(inlineStr, globals, resolving)
+		if err != nil || !isEscaped {
+			return val, err
+		}
+		// the escaped "$(" is left in the default or the kept reference
+		return unescapeVarPrefix(val), nil
+	}
+
+	// undefined global variables are reported together
+	undefinedVars := &undefinedGlobalVarError{}
+	var lookupErr error
+	var replaced strings.Builder
+	last := 0
+	for _, match := range matches {
+		findStr := inlineStr[match[0]:match[1]]
+		replaced.WriteString(inlineStr[last:match[0]])
+		last = match[1]
+		globalVar, err := r.lookupGlobalVarRef(findStr, globals, resolving)
+		if err == nil {
+			var interpolated interface{}
+			if interpolated, err = interpolate(findStr, globalVar); err == nil {
+				replaced.WriteString(interpolated.(string))
+				continue
+			}
+		}
+		if err = undefinedVars.collect(err, "", ""); err != nil && lookupErr == nil {
+			lookupErr = err
+		}
+		replaced.WriteString(findStr)
+	}
+	replaced.WriteString(inlineStr[last:])
+	if lookupErr != nil {
+		return nil, lookupErr
+	}
+	if err := undefinedVars.orNil(); err != nil {
+		return nil, err
+	}
+	return strings.ReplaceAll(replaced.String(), escapedVarPrefix, "$("), nil
+}
+
+// unescapeVarPrefix turns the placeholder of escaped "$(" in the string val back to "$("
+func unescapeVarPrefix(val interface{}) interface{} {
+	if str, ok := val.(string); ok {
+		return strings.ReplaceAll(str, escapedVarPrefix, "$(")
+	}
+	return val
+}
+
+// interpolate formats the value of global variable ref as a part of string.
+// It fails if the value is a map or a list.
+func interpolate(ref string, val interface{}) (interface{}, error) {
+	switch val.(type) {
+	case map[string]interface{}:
+		return nil, fmt.Errorf("can not interpolate map global %s into a string", ref)
+	case []interface{}:
+		return nil, fmt.Errorf("can not interpolate list global %s into a string", ref)
+	}
+	return formatScalar(val), nil
+}
+
+// lookupGlobalVarRef returns the value of the reference ref, i.e. "$(name)".
+// The references in ref are replaced first, i.e. "$(a:-$(b))" is looked up as "$(a:-x)" if b is x.
+func (r *globalsResolver) lookupGlobalVarRef(ref string, globals map[string]interface{}, resolving []string) (interface{}, error) {
+	expr := ref[2 : len(ref)-1]
+	if len(findGlobalVars(expr)) > 0 {
+		replaced, err := r.replaceGlobalVarInString(expr, globals, resolving)
+		if err != nil {
+			return nil, err
+		}
+		expr = fmt.Sprintf("%v", replaced)
+	}
+	return r.lookupGlobalVar(expr, globals, resolving)
+}
+
+// lookupGlobalVar returns the value of global variable expression.
+// The expression is "name", optionally followed by ":-default" which falls back to default
+// if name is not defined, and then by the functions applied in order with pipes, i.e. "$(port:-80|int)".
+// The default is typed as yaml, i.e. "$(replicas:-3)" yields 3.
+// Global variables referred in the value are replaced as well.
+func (r *globalsResolver) lookupGlobalVar(expr string, globals map[string]interface{}, resolving []string) (interface{}, error) {
+	original := expr
+	var funcs []string
+	if i := strings.Index(expr, "|"); i >= 0 {
+		expr, funcs = expr[:i], strings.Split(expr[i+1:], "|")
+	}
+	name, defaultVal, hasDefault := expr, "", false
+	if i := strings.Index(expr, ":-"); i >= 0 {
+		name, defaultVal, hasDefault = expr[:i], expr[i+2:], true
+	}
+
+	val, err := r.resolveGlobalVar(name, defaultVal, hasDefault, globals, resolving)
+	if _, isUndefined := err.(*undefinedGlobalVarError); isUndefined {
+		switch r.OnUndefined {
+		case undefinedGlobalKeep:
+			r.logger.Warnf("Global variable $(%s) is not defined, kept as it is", name)
+			return "$(" + original + ")", nil
+		case undefinedGlobalEmpty:
+			r.logger.Warnf("Global variable $(%s) is not defined, replaced with empty string", name)
+			return "", nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.EmptyAsDefault && hasDefault && val == "" {
+		val = inferScalar(defaultVal)
+	}
+	for _, fn := range funcs {
+		if val, err = applyGlobalVarFunc(val, fn); err != nil {
+			return nil, errors.Wrapf(err, "can not apply %s to $(%s)", fn, name)
+		}
+	}
+	return val, nil
+}
+
+// resolveGlobalVar returns the value of global variable name, or defaultVal if it is not defined
+func (r *globalsResolver) resolveGlobalVar(name, defaultVal string, hasDefault bool, globals map[string]interface{}, resolving []string) (interface{}, error) {
+	if strings.HasPrefix(name, chartRefPrefix) {
+		val, err := r.resolveChartRef(name, resolving)
+		if _, isUndefined := err.(*undefinedGlobalVarError); !isUndefined || !hasDefault {
+			return val, err
+		}
+	} else if globalVar := lookupGlobal(globals, name); globalVar != nil {
+		for i, resolvingName := range resolving {
+			if resolvingName == name {
+				cycle := append(append([]string{}, resolving[i:]...), name)
+				return nil, errors.New("Cycle in global variables: " + strings.Join(cycle, " -> "))
+			}
+		}
+		r.countSubstitution(resolving)
+		return r.replaceGlobalVarWith(globalVar, globals, append(resolving[:len(resolving):len(resolving)], name))
+	}
+	// environment variables are always strings, and they are not replaced further
+	if r.AllowEnv && !strings.HasPrefix(name, chartRefPrefix) {
+		if envVar, ok := os.LookupEnv(name); ok {
+			r.countSubstitution(resolving)
+			return envVar, nil
+		}
+	}
+	// return error if global variable is not defined
+	if !hasDefault {
+		return nil, &undefinedGlobalVarError{refs: []globalVarRef{{name: name}}}
+	}
+	r.countSubstitution(resolving)
+	return inferScalar(defaultVal), nil
+}
+
+// lookupGlobal returns the global variable name, or nil if it is not defined.
+// A dotted name walks into the nested maps, i.e. "cluster.region", unless it is defined as it is.
+func lookupGlobal(globals map[string]interface{}, name string) interface{} {
+	if globalVar, ok := globals[name]; ok || !strings.Contains(name, ".") {
+		return globalVar
+	}
+	var current interface{} = globals
+	for _, key := range strings.Split(name, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = m[key]
+	}
+	return current
+}
+
+// resolveChartRef returns the value another chart sets in its override for ref, i.e. "@api.ingress.host".
+// The first segment is the name of chart and the rest is the path in the values.
+// Only the override paths overlapping the path are resolved, with the globals of the chart.
+func (p *plugin) resolveChartRef(ref string, resolving []string) (interface{}, error) {
+	for i, resolvingName := range resolving {
+		if resolvingName == ref {
+			cycle := append(append([]string{}, resolving[i:]...), ref)
+			return nil, errors.New("Cycle in global variables: " + strings.Join(cycle, " -> "))
+		}
+	}
+	refPaths, err := splitOverridePath(ref[len(chartRefPrefix):])
+	if err != nil || len(refPaths) < 2 {
+		return nil, fmt.Errorf("invalid chart reference $(%s)", ref)
+	}
+	var chart *ReplacedChart
+	for i := range p.Charts {
+		if !p.Charts[i].NameRegex && p.Charts[i].Name == refPaths[0] {
+			chart = &p.Charts[i]
+			break
+		}
+	}
+	if chart == nil {
+		return nil, &undefinedGlobalVarError{refs: []globalVarRef{{name: ref}}}
+	}
+
+	globals := p.chartGlobals(*chart, chart.Name, chart.Namespace)
+	if chart.RawValues {
+		globals = nil
+	}
+	resolving = append(resolving[:len(resolving):len(resolving)], ref)
+	values := map[string]interface{}{}
+	override := p.mergedOverride(*chart)
+	for _, inlinePath := range sortedKeys(override) {
+		resolvedPath, err := p.replaceGlobalVarWith(inlinePath, globals, resolving)
+		if err != nil {
+			return nil, err
+		}
+		paths, err := splitOverridePath(fmt.Sprintf("%v", resolvedPath))
+		if err != nil {
+			return nil, err
+		}
+		if !hasPathPrefix(paths, refPaths[1:]) && !hasPathPrefix(refPaths[1:], paths) {
+			continue
+		}
+		val, err := p.replaceGlobalVarWith(override[inlinePath], globals, resolving)
+		if err != nil {
+			return nil, err
+		}
+		if val == deleteDirective {
+			val = deletion{}
+		}
+		if _, err = p.createMapFromPaths(values, nil, paths, val); err != nil {
+			return nil, errors.Wrapf(err, "invalid override path %s of chart %s", inlinePath, chart.Name)
+		}
+	}
+	val, ok := lookupValue(values, refPaths[1:])
+	if !ok || val == nil {
+		return nil, &undefinedGlobalVarError{refs: []globalVarRef{{name: ref}}}
+	}
+	p.countSubstitution(resolving[:len(resolving)-1])
+	return val, nil
+}
+
+// hasPathPrefix reports whether paths starts with prefix
+func hasPathPrefix(paths, prefix []string) bool {
+	return len(paths) >= len(prefix) && equalPaths(paths[:len(prefix)], prefix)
+}
+
+// equalPaths reports whether the path segments a and b are the same, where an index in brackets,
+// i.e. "[0]", is the same as the numeric segment
+func equalPaths(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] && strings.Trim(a[i], "[]") != strings.Trim(b[i], "[]") {
+			return false
+		}
+	}
+	return true
+}
+
+// applyGlobalVarFunc applies the function fn to val.
+// fn is a name of function followed by the arguments separated with colons, i.e. "replace:_:-".
+// int, float, bool and string cast val to the type, and the others manipulate val as a string.
+func applyGlobalVarFunc(val interface{}, fn string) (interface{}, error) {
+	args := strings.Split(fn, ":")
+	name, args := args[0], args[1:]
+	switch name {
+	case "int":
+		return castToInt(val)
+	case "float":
+		return castToFloat(val)
+	case "bool":
+		return castToBool(val)
+	case "string":
+		return formatScalar(val), nil
+	case "upper":
+		return strings.ToUpper(formatScalar(val)), nil
+	case "lower":
+		return strings.ToLower(formatScalar(val)), nil
+	case "trim":
+		return strings.TrimSpace(formatScalar(val)), nil
+	case "replace":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("replace expects 2 arguments but got %d", len(args))
+		}
+		return strings.ReplaceAll(formatScalar(val), args[0], args[1]), nil
+	case "regexReplace":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("regexReplace expects 2 arguments but got %d", len(args))
+		}
+		re, err := regexp.Compile(args[0])
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid pattern of regexReplace")
+		}
+		return re.ReplaceAllString(formatScalar(val), args[1]), nil
+	case "b64enc":
+		return base64.StdEncoding.EncodeToString([]byte(formatScalar(val))), nil
+	case "b64dec":
+		decoded, err := base64.StdEncoding.DecodeString(formatScalar(val))
+		if err != nil {
+			return nil, err
+		}
+		return string(decoded), nil
+	}
+	return nil, errors.New("unknown function " + name)
+}
+
+// castToInt converts a whole number or a numeric string to int
+func castToInt(val interface{}) (interface{}, error) {
+	switch v := val.(type) {
+	case int:
+		return v, nil
+	case float64:
+		if v != float64(int(v)) {
+			return nil, fmt.Errorf("%v is not an integer", v)
+		}
+		return int(v), nil
+	case string:
+		return strconv.Atoi(strings.TrimSpace(v))
+	}
+	return nil, fmt.Errorf("%v is not an integer", val)
+}
+
+// castToFloat converts a number or a numeric string to float64
+func castToFloat(val interface{}) (interface{}, error) {
+	switch v := val.(type) {
+	case int:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(v), 64)
+	}
+	return nil, fmt.Errorf("%v is not a number", val)
+}
+
+// castToBool converts a bool or a string such as "true" and "false" to bool
+func castToBool(val interface{}) (interface{}, error) {
+	switch v := val.(type) {
+	case bool:
+		return v, nil
+	case string:
+		return strconv.ParseBool(strings.TrimSpace(v))
+	}
+	return nil, fmt.Errorf("%v is not a bool", val)
+}
+
+// formatScalar formats val as a string, which keeps floats in decimal notation
+func formatScalar(val interface{}) string {
+	if v, ok := val.(float64); ok {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", val)
+}
+
+// countSubstitution counts a global variable substituted in chart, not in the other global variables
+func (p *plugin) countSubstitution(resolving []string) {
+	if len(resolving) == 0 {
+		p.substitutions++
+		p.stats.Substitutions++
+	}
+}
+
+// inferScalar parses str as a yaml scalar, i.e. "3" -> 3 and "true" -> true.
+// str itself is returned if it is empty or not a scalar.
+func inferScalar(str string) interface{} {
+	if str == "" {
+		return str
+	}
+	var val interface{}
+	if err := yaml.Unmarshal([]byte(str), &val); err != nil || val == nil {
+		return str
 	}
-	return inlineStr, nil
+	switch val.(type) {
+	case map[string]interface{}, []interface{}:
+		return str
+	}
+	return val
+}
+
+// splitOverridePath splits inlinePath by dots into the path segments.
+// A dot inside a map key is escaped with a backslash or the key is quoted in brackets,
+// i.e. `annotations.nginx\.ingress\.kubernetes\.io/rewrite-target` or
+// `annotations["nginx.ingress.kubernetes.io/rewrite-target"]`
+func splitOverridePath(inlinePath string) ([]string, error) {
+	var paths []string
+	var segment strings.Builder
+	closed := false
+	for i := 0; i < len(inlinePath); i++ {
+		c := inlinePath[i]
+		if closed && c != '.' && c != '[' {
+			return nil, fmt.Errorf("unexpected %q after brackets in path %s", c, inlinePath)
+		}
+		switch {
+		case c == '\\' && i+1 < len(inlinePath) && inlinePath[i+1] == '.':
+			segment.WriteByte('.')
+			i++
+		case c == '.':
+			if !closed {
+				paths = addSegment(paths, segment.String())
+			}
+			segment.Reset()
+			closed = false
+		case c == '[' && i+1 < len(inlinePath) && inlinePath[i+1] == ']':
+			if segment.Len() > 0 {
+				paths = append(paths, segment.String())
+				segment.Reset()
+			}
+			paths = append(paths, appendSegment)
+			i++
+			closed = true
+		case c == '[' && indexSegmentRe.MatchString(inlinePath[i:]):
+			if segment.Len() > 0 {
+				paths = append(paths, segment.String())
+				segment.Reset()
+			}
+			index := indexSegmentRe.FindString(inlinePath[i:])
+			paths = append(paths, index)
+			i += len(index) - 1
+			closed = true
+		case c == '[' && i+1 < len(inlinePath) && (inlinePath[i+1] == '"' || inlinePath[i+1] == '\''):
+			end := strings.Index(inlinePath[i+2:], string(inlinePath[i+1])+"]")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated brackets in path %s", inlinePath)
+			}
+			if segment.Len() > 0 {
+				paths = append(paths, segment.String())
+				segment.Reset()
+			}
+			paths = append(paths, inlinePath[i+2:i+2+end])
+			i += end + 3
+			closed = true
+		default:
+			segment.WriteByte(c)
+		}
+	}
+	if !closed {
+		paths = addSegment(paths, segment.String())
+	}
+	return paths, nil
 }
 
-func splitButIgnoreEscapedDot(input, placeholder string) []string {
-	temp := strings.ReplaceAll(input, "\\.", placeholder)
-	parts := strings.Split(temp, ".")
+// indexSegmentRe matches the index in brackets at the beginning, i.e. "[0]" of "[0].image"
+var indexSegmentRe = regexp.MustCompile(`^\[-?[0-9]+\]`)
+
+// mergeKeyRe matches the segment with the merge key in parentheses, i.e. "env(name)"
+var mergeKeyRe = regexp.MustCompile(`^(.+)\(([^()]+)\)$`)
 
-	for i := range parts {
-		parts[i] = strings.ReplaceAll(parts[i], placeholder, ".")
+// addSegment appends segment to paths, splitting the merge key in parentheses into another segment
+func addSegment(paths []string, segment string) []string {
+	if m := mergeKeyRe.FindStringSubmatch(segment); m != nil {
+		return append(paths, m[1], "("+m[2]+")")
 	}
-	return parts
+	return append(paths, segment)
 }
@@ -1,9 +1,27 @@
 package main_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"plugin"
+	"reflect"
+	"strings"
 	"testing"
 
+	"sigs.k8s.io/kustomize/api/loader"
+	"sigs.k8s.io/kustomize/api/provider"
+	"sigs.k8s.io/kustomize/api/resmap"
 	kusttest_test "sigs.k8s.io/kustomize/api/testutils/kusttest"
+	"sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
 )
 
 func TestHelmValuesTransformerChartSource(t *testing.T) {
@@ -411,3 +429,7348 @@ spec:
         enabled: true
 `)
 }
+
+func TestFluxV2HelmRelease(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  admin_keyring: abcdefghijklmn
+charts:
+  - name: glance
+    source:
+      repository: openstack-charts
+      name: glance
+      version: 1.0.0
+      type: helmrepo
+    override:
+      conf.ceph.admin_keyring: $(admin_keyring)
+      conf.ceph.enabled: true
+  - name: cinder
+    source:
+      version: 2.0.0
+    override:
+      conf.ceph.enabled: true
+`, `
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    spec:
+      chart: TO_BE_FIXED
+      sourceRef:
+        kind: GitRepository
+        name: TO_BE_FIXED
+      version: 0.1.0
+  releaseName: glance
+  targetNamespace: openstack
+  values:
+    conf:
+      ceph:
+        admin_keyring: TACO_FIXME
+        enabled: false
+---
+apiVersion: helm.toolkit.fluxcd.io/v2beta2
+kind: HelmRelease
+metadata:
+  name: cinder
+spec:
+  chart:
+    spec:
+      chart: cinder
+      sourceRef:
+        kind: HelmRepository
+        name: openstack-charts
+      version: 0.1.0
+  releaseName: cinder
+  targetNamespace: openstack
+  values:
+    conf:
+      ceph:
+        enabled: false
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    spec:
+      chart: glance
+      sourceRef:
+        kind: HelmRepository
+        name: openstack-charts
+      version: 1.0.0
+  releaseName: glance
+  targetNamespace: openstack
+  values:
+    conf:
+      ceph:
+        admin_keyring: abcdefghijklmn
+        enabled: true
+---
+apiVersion: helm.toolkit.fluxcd.io/v2beta2
+kind: HelmRelease
+metadata:
+  name: cinder
+spec:
+  chart:
+    spec:
+      chart: cinder
+      sourceRef:
+        kind: HelmRepository
+        name: openstack-charts
+      version: 2.0.0
+  releaseName: cinder
+  targetNamespace: openstack
+  values:
+    conf:
+      ceph:
+        enabled: true
+`)
+}
+
+func TestTargetGvk(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+targetGvk:
+  group: platform.example.com
+  version: v1
+  kind: HelmApp
+global:
+  admin_keyring: abcdefghijklmn
+charts:
+  - name: glance
+    source:
+      version: 1.0.0
+    override:
+      conf.ceph.admin_keyring: $(admin_keyring)
+`, `
+apiVersion: platform.example.com/v1
+kind: HelmApp
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 0.1.0
+  values:
+    conf:
+      ceph:
+        admin_keyring: TACO_FIXME
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values:
+    conf:
+      ceph:
+        admin_keyring: TACO_FIXME
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: platform.example.com/v1
+kind: HelmApp
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    conf:
+      ceph:
+        admin_keyring: abcdefghijklmn
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values:
+    conf:
+      ceph:
+        admin_keyring: TACO_FIXME
+`)
+}
+
+func TestTargetGvkWithoutKind(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+targetGvk:
+  group: platform.example.com
+  version: v1
+charts:
+  - name: glance
+    override:
+      conf.ceph.enabled: true
+`, `
+apiVersion: platform.example.com/v1
+kind: HelmApp
+metadata:
+  name: glance
+spec:
+  values: {}
+`)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "kind of targetGvk") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestGlobalVarDefault(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  docker_registry: sktdev
+charts:
+  - name: glance
+    override:
+      replicas: $(replicas:-3)
+      conf.ceph.enabled: $(ceph_enabled:-true)
+      conf.ceph.admin_keyring: $(admin_keyring:-)
+      images.tags.api: $(docker_registry:-docker.io)/glance:$(image_tag:-latest)
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values:
+    replicas: 1
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart: {}
+  values:
+    conf:
+      ceph:
+        admin_keyring: ""
+        enabled: true
+    images:
+      tags:
+        api: sktdev/glance:latest
+    replicas: 3
+`)
+}
+
+func TestUndefinedGlobalVarWithoutDefault(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      replicas: $(replicas)
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values:
+    replicas: 1
+`)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "Can not found global variable named $(replicas)") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestEscapedGlobalVar(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  env: prod
+charts:
+  - name: glance
+    override:
+      job.command: echo $(env)-$$(date +%s)
+      job.literal: $$(env)
+      job.args:
+      - $(env)
+      - $$(hostname)
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values:
+    job:
+      command: TO_BE_FIXED
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart: {}
+  values:
+    job:
+      args:
+      - prod
+      - $(hostname)
+      command: echo prod-$(date +%s)
+      literal: $(env)
+`)
+}
+
+func TestArrayIndexPath(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      containers.1.resources.limits.cpu: 500m
+      containers.1.image: glance:1.0.0
+      sidecars[1].name: logger
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values:
+    containers:
+    - name: init
+      image: busybox
+    - name: api
+      image: glance:0.1.0
+      resources:
+        limits:
+          memory: 1Gi
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart: {}
+  values:
+    containers:
+    - image: busybox
+      name: init
+    - image: glance:1.0.0
+      name: api
+      resources:
+        limits:
+          cpu: 500m
+          memory: 1Gi
+    sidecars:
+    - null
+    - name: logger
+`)
+}
+
+func TestArrayIndexPathIntoMap(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      conf[0].enabled: true
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values:
+    conf:
+      ceph:
+        enabled: false
+`)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "invalid override path conf[0].enabled") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestDottedKeyPath(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      ingress.annotations.nginx\.ingress\.kubernetes\.io/rewrite-target: /
+      ingress.annotations["nginx.ingress.kubernetes.io/ssl-redirect"]: "false"
+      ingress.labels['app.kubernetes.io/name'].value: glance
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values:
+    ingress:
+      annotations:
+        kubernetes.io/ingress.class: nginx
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart: {}
+  values:
+    ingress:
+      annotations:
+        kubernetes.io/ingress.class: nginx
+        nginx.ingress.kubernetes.io/rewrite-target: /
+        nginx.ingress.kubernetes.io/ssl-redirect: "false"
+      labels:
+        app.kubernetes.io/name:
+          value: glance
+`)
+}
+
+func TestUnterminatedBracketPath(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      ingress.annotations["nginx.ingress.kubernetes.io/rewrite-target: /
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values: {}
+`)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "unterminated brackets") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestAllUndefinedGlobalVars(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  docker_registry: sktdev
+charts:
+  - name: glance
+    source:
+      repository: $(repository)
+    override:
+      images.tags.api: $(docker_registry)/glance:$(image_tag)
+      conf.ceph.admin_keyring: $(glance_admin_keyring)
+  - name: cinder
+    override:
+      conf.ceph.admin_keyring: $(cinder_admin_keyring)
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values: {}
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: cinder
+spec:
+  values: {}
+`)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	expected := "Can not found global variables named " +
+		"$(cinder_admin_keyring) in chart cinder at override.conf.ceph.admin_keyring, " +
+		"$(glance_admin_keyring) in chart glance at override.conf.ceph.admin_keyring, " +
+		"$(image_tag) in chart glance at override.images.tags.api, " +
+		"$(repository) in chart glance at source.repository"
+	if err.Error() != expected {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestMissingHelmRelease(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      conf.ceph.enabled: true
+  - name: cinder
+    override:
+      conf.ceph.enabled: true
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values:
+    conf:
+      ceph:
+        enabled: false
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart: {}
+  values:
+    conf:
+      ceph:
+        enabled: true
+`)
+}
+
+func TestStrictMissingHelmRelease(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+strict: true
+charts:
+  - name: cinder
+    override:
+      conf.ceph.enabled: true
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values: {}
+`)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "Can't find HelmRelease name: cinder") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestUnknownLogLevel(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+logLevel: verbose
+charts:
+  - name: glance
+    override:
+      conf.ceph.enabled: true
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values: {}
+`)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "unknown logLevel verbose") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestMalformedHelmRelease(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    source:
+      version: 1.0.0
+    override:
+      conf.ceph.enabled: true
+`
+	for input, expected := range map[string]string{
+		`
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec: glance
+`: "spec is not a mapping in HelmRelease glance",
+		`
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart: glance-1.0.0
+`: "spec.chart is not a mapping in HelmRelease glance",
+		`
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values:
+  - conf
+`: "spec.values is not a mapping in HelmRelease glance",
+		`
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values:
+    conf: ceph
+`: "can not set ceph into string",
+	} {
+		err := th.ErrorFromLoadAndRunTransformer(config, input)
+		if err == nil {
+			t.Fatalf("expected an error")
+		}
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestNestedGlobalVars(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  domain: example.com
+  apiHost: api.$(domain)
+  apiUrl: https://$(apiHost)
+  endpoint: $(apiUrl)
+charts:
+  - name: glance
+    override:
+      endpoints.host: $(apiHost)
+      endpoints.public: $(endpoint)/v2
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values: {}
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart: {}
+  values:
+    endpoints:
+      host: api.example.com
+      public: https://api.example.com/v2
+`)
+}
+
+func TestCyclicGlobalVars(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  a: $(b)
+  b: prefix-$(a)
+charts:
+  - name: glance
+    override:
+      endpoints.host: host-$(a)
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values: {}
+`)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "Cycle in global variables: a -> b -> a") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestOverrideList(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+    - resources:
+        limits:
+          cpu: 500m
+          memory: 1Gi
+      replicas: 1
+    - resources:
+        limits:
+          memory: 2Gi
+      replicas: 3
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values: {}
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart: {}
+  values:
+    replicas: 3
+    resources:
+      limits:
+        cpu: 500m
+        memory: 2Gi
+`)
+}
+
+func TestCommonOverride(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  pullSecret: regcred
+commonOverride:
+  imagePullSecrets:
+  - name: $(pullSecret)
+  nodeSelector:
+    role: control-plane
+    zone: a
+charts:
+  - name: glance
+    override:
+      nodeSelector:
+        zone: b
+  - name: cinder
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values: {}
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: cinder
+spec:
+  values: {}
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart: {}
+  values:
+    imagePullSecrets:
+    - name: regcred
+    nodeSelector:
+      role: control-plane
+      zone: b
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: cinder
+spec:
+  chart: {}
+  values:
+    imagePullSecrets:
+    - name: regcred
+    nodeSelector:
+      role: control-plane
+      zone: a
+`)
+}
+
+func TestDeleteOverride(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      ingress.tls: $delete
+      ingress.hosts.0: $delete
+      ingress.annotations: null
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values:
+    ingress:
+      annotations:
+        kubernetes.io/ingress.class: nginx
+      enabled: true
+      hosts:
+      - glance.example.com
+      - image.example.com
+      tls:
+      - secretName: glance-tls
+        hosts:
+        - glance.example.com
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart: {}
+  values:
+    ingress:
+      enabled: true
+      hosts:
+      - image.example.com
+`)
+}
+
+func TestDeleteOverrideInList(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+mergeValues: %t
+charts:
+  - name: glance
+    override:
+      containers.0.image: $delete
+      ports.0: $delete
+      ports.1: $delete
+      ports.-1: $delete
+      conf.debug: $delete
+      missing.key: $delete
+`
+	for _, mergeValues := range []bool{false, true} {
+		rm := th.LoadAndRunTransformer(fmt.Sprintf(config, mergeValues), `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    conf:
+      verbose: true
+    containers:
+    - name: api
+      image: glance:1.0.0
+    ports: [80, 443, 8080, 9090]
+`)
+		th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    conf:
+      verbose: true
+    containers:
+    - name: api
+    ports:
+    - 8080
+`)
+	}
+}
+
+func TestReport(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	reportPath := filepath.Join(t.TempDir(), "report.txt")
+	th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+report: true
+reportPath: `+reportPath+`
+global:
+  repository: http://repository:8879
+  admin_keyring: abcdefghijklmn
+charts:
+  - name: glance
+    source:
+      repository: $(repository)
+      version: 1.0.0
+    override:
+      conf.ceph.admin_keyring: $(admin_keyring)
+      conf.ceph.enabled: true
+      images.tags.api: $(repository)/glance:$(tag:-latest)
+  - name: cinder
+    override:
+      conf.ceph.enabled: true
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values: {}
+`)
+	report, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `chart glance: source {"repository":"http://repository:8879","version":"1.0.0"}, ` +
+		`override [conf.ceph.admin_keyring, conf.ceph.enabled, images.tags.api], 4 global variables substituted
+chart cinder: skipped without HelmRelease
+`
+	if string(report) != expected {
+		t.Fatalf("unexpected report: %s", report)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+dryRun: true
+charts:
+  - name: glance
+    source:
+      version: 1.0.0
+    override:
+      conf.ceph.enabled: true
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 0.1.0
+  values:
+    conf:
+      ceph:
+        enabled: false
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 0.1.0
+  values:
+    conf:
+      ceph:
+        enabled: false
+`)
+}
+
+func TestValuesSchema(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	th.WriteF("glance-schema.yaml", `
+type: object
+additionalProperties: false
+properties:
+  replicas:
+    type: integer
+  resources:
+    type: object
+    additionalProperties: false
+    properties:
+      limits:
+        type: object
+        properties:
+          cpu:
+            type: string
+`)
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values: {}
+`
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    valuesSchema: glance-schema.yaml
+    override:
+      replicas: 3
+      resources.limits.cpu: 500m
+`, input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart: {}
+  values:
+    replicas: 3
+    resources:
+      limits:
+        cpu: 500m
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    valuesSchema: glance-schema.yaml
+    override:
+      resourcs.limits.cpu: 500m
+`, input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "invalid override of chart glance") ||
+		!strings.Contains(err.Error(), "resourcs") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestNameRegex(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: app-.*
+    nameRegex: true
+    override:
+      replicas: 3
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: app-api
+spec:
+  values:
+    replicas: 1
+---
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: app-worker
+spec:
+  values:
+    replicas: 1
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: my-app-db
+spec:
+  values:
+    replicas: 1
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  replicas: "1"
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: app-api
+spec:
+  chart: {}
+  values:
+    replicas: 3
+---
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: app-worker
+spec:
+  chart:
+    spec: {}
+  values:
+    replicas: 3
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: my-app-db
+spec:
+  values:
+    replicas: 1
+---
+apiVersion: v1
+data:
+  replicas: "1"
+kind: ConfigMap
+metadata:
+  name: app-config
+`)
+}
+
+func TestStrictNameRegexWithoutMatch(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+strict: true
+charts:
+  - name: app-.*
+    nameRegex: true
+    override:
+      replicas: 3
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values: {}
+`)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "Can't find HelmRelease name: app-.*") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestGlobalVarInOverridePath(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  env: prod
+  region: kr.seoul
+  domain: example.com
+charts:
+  - name: glance
+    override:
+      ingress.$(env).host: glance.$(domain)
+      zones.$(region): true
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values: {}
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart: {}
+  values:
+    ingress:
+      prod:
+        host: glance.example.com
+    zones:
+      kr:
+        seoul: true
+`)
+}
+
+func TestOverridePathOrder(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	for i := 0; i < 10; i++ {
+		rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      conf.ceph.enabled: true
+      conf:
+        ceph:
+          admin_keyring: abcde
+        rbd:
+          enabled: false
+      conf.rbd.pool: images
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values: {}
+`)
+		th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart: {}
+  values:
+    conf:
+      ceph:
+        admin_keyring: abcde
+        enabled: true
+      rbd:
+        enabled: false
+        pool: images
+`)
+	}
+}
+
+func TestChartGlobals(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  replicas: 3
+  domain: example.com
+  host: $(name).$(domain)
+charts:
+  - name: app-api
+    globals:
+      name: api
+    override:
+      replicas: $(replicas)
+      ingress.host: $(host)
+  - name: app-worker
+    globals:
+      name: worker
+      replicas: 10
+    override:
+      replicas: $(replicas)
+      ingress.host: $(host)
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: app-api
+spec:
+  values: {}
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: app-worker
+spec:
+  values: {}
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: app-api
+spec:
+  chart: {}
+  values:
+    ingress:
+      host: api.example.com
+    replicas: 3
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: app-worker
+spec:
+  chart: {}
+  values:
+    ingress:
+      host: worker.example.com
+    replicas: 10
+`)
+}
+
+func TestGlobalsFrom(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	th.WriteF("globals/base.yaml", `
+docker_registry: docker.io
+image_tag: latest
+admin_keyring: base-keyring
+`)
+	th.WriteF("globals/site.yaml", `
+docker_registry: sktdev
+image_tag: taco-0.1.0
+`)
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+globalsFrom:
+  - globals/base.yaml
+  - globals/site.yaml
+global:
+  image_tag: taco-0.2.0
+charts:
+  - name: glance
+    override:
+      images.tags.api: $(docker_registry)/glance:$(image_tag)
+      conf.ceph.admin_keyring: $(admin_keyring)
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values: {}
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart: {}
+  values:
+    conf:
+      ceph:
+        admin_keyring: base-keyring
+    images:
+      tags:
+        api: sktdev/glance:taco-0.2.0
+`)
+}
+
+func TestGlobalsFromMissingFile(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+globalsFrom:
+  - globals/missing.yaml
+charts:
+  - name: glance
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values: {}
+`)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "can not read globalsFrom globals/missing.yaml") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestGlobalVarCast(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values: {}
+`
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  port: "8080"
+  enabled: "true"
+  ratio: "0.5"
+  replicas: 3
+charts:
+  - name: glance
+    override:
+      service.port: $(port|int)
+      service.enabled: $(enabled|bool)
+      service.ratio: $(ratio|float)
+      service.replicas: $(replicas|string)
+      service.timeout: $(timeout:-30|int)
+`, input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart: {}
+  values:
+    service:
+      enabled: true
+      port: 8080
+      ratio: 0.5
+      replicas: "3"
+      timeout: 30
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  port: http
+charts:
+  - name: glance
+    override:
+      service.port: $(port|int)
+`, input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "can not apply int to $(port)") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestChartVersion(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  glanceVersion: 1.2.3
+charts:
+  - name: glance
+    chartVersion: $(glanceVersion)
+  - name: keystone
+    source:
+      version: 0.1.0
+    chartVersion: 0.2.0
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    repository: https://openinfradev.github.io/helm-repo
+    name: glance
+    version: 1.0.0
+---
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    spec:
+      chart: keystone
+      version: 0.0.1
+      sourceRef:
+        kind: HelmRepository
+        name: openinfradev
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    name: glance
+    repository: https://openinfradev.github.io/helm-repo
+    version: 1.2.3
+---
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    spec:
+      chart: keystone
+      sourceRef:
+        kind: HelmRepository
+        name: openinfradev
+      version: 0.2.0
+`)
+}
+
+func TestMergeValues(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+mergeValues: true
+charts:
+  - name: glance
+    source:
+      version: 1.0.0
+    override:
+      foo.b: 2
+      bar: null
+      images.tags: [glance]
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values:
+    foo:
+      a: 1
+    bar:
+      c: 3
+    images:
+      tags: [keystone, horizon]
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    foo:
+      a: 1
+      b: 2
+    images:
+      tags:
+      - glance
+`)
+}
+
+func BenchmarkTransform(b *testing.B) {
+	// the harness requires *testing.T, which only reports the failures to build the plugin
+	th := kusttest_test.MakeEnhancedHarness(&testing.T{}).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	const releases = 300
+	var config, input strings.Builder
+	config.WriteString(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+logLevel: silent
+charts:
+`)
+	for i := 0; i < releases; i++ {
+		fmt.Fprintf(&config, "  - name: chart-%d\n    override:\n      replicas: 2\n", i)
+		fmt.Fprintf(&input, `---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: chart-%d
+spec:
+  values:
+    replicas: 1
+`, i)
+	}
+	m, err := resmap.NewFactory(provider.NewDefaultDepProvider().GetResourceFactory()).
+		NewResMapFromBytes([]byte(input.String()))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = th.RunTransformerFromResMap(config.String(), m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestAppendOverride(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    image: glance
+    extraEnv:
+    - name: LOG_LEVEL
+      value: info
+`
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      extraEnv[]:
+      - name: SIDECAR
+        value: enabled
+      extraVolumes[]:
+      - name: cache
+`, input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    extraEnv:
+    - name: LOG_LEVEL
+      value: info
+    - name: SIDECAR
+      value: enabled
+    extraVolumes:
+    - name: cache
+    image: glance
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      image[]:
+      - keystone
+`, input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "can not append to string") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestOnUndefinedGlobal(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values: {}
+`
+	config := `
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+logLevel: silent
+onUndefinedGlobal: %s
+global:
+  domain: example.com
+charts:
+  - name: glance
+    override:
+      endpoint: api.$(domain)/$(region)
+      storage: $(storageClass)
+`
+	rm := th.LoadAndRunTransformer(fmt.Sprintf(config, "keep"), input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    endpoint: api.example.com/$(region)
+    storage: $(storageClass)
+`)
+
+	rm = th.LoadAndRunTransformer(fmt.Sprintf(config, "empty"), input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    endpoint: api.example.com/
+    storage: ""
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(fmt.Sprintf(config, "ignore"), input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "unknown onUndefinedGlobal ignore") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSourceRef(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  env: prod
+charts:
+  - name: keystone
+    chartVersion: 0.2.0
+    sourceRef:
+      name: openinfradev-$(env)
+      namespace: flux-system
+`, `
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    spec:
+      chart: keystone
+      version: 0.1.0
+      sourceRef:
+        kind: HelmRepository
+        name: openinfradev
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    spec:
+      chart: keystone
+      sourceRef:
+        kind: HelmRepository
+        name: openinfradev-prod
+        namespace: flux-system
+      version: 0.2.0
+`)
+}
+
+func TestValuesFrom(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  env: prod
+charts:
+  - name: keystone
+    valuesFrom:
+    - kind: ConfigMap
+      name: keystone-values
+    - kind: Secret
+      name: keystone-$(env)-secrets
+      valuesKey: secrets.yaml
+  - name: glance
+    valuesFrom:
+    - kind: Secret
+      name: glance-secrets
+      optional: true
+`, `
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    spec:
+      chart: keystone
+  valuesFrom:
+  - kind: ConfigMap
+    name: keystone-values
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    name: glance
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    spec:
+      chart: keystone
+  valuesFrom:
+  - kind: ConfigMap
+    name: keystone-values
+  - kind: Secret
+    name: keystone-prod-secrets
+    valuesKey: secrets.yaml
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    name: glance
+  valuesFrom:
+  - secretKeyRef:
+      name: glance-secrets
+      optional: true
+`)
+}
+
+func TestDuplicateCharts(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values: {}
+`
+	config := `
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+mergeDuplicates: %t
+charts:
+  - name: glance
+    override:
+      image: glance
+      replicas: 1
+  - name: glance
+    override:
+      replicas: 3
+  - name: gl.*
+    nameRegex: true
+  - name: gl.*
+    nameRegex: true
+`
+	err := th.ErrorFromLoadAndRunTransformer(fmt.Sprintf(config, false), input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "duplicate charts named glance") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rm := th.LoadAndRunTransformer(fmt.Sprintf(config, true), input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    image: glance
+    replicas: 3
+`)
+}
+
+func TestReplaceOverride(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    image: glance
+    conf:
+      debug: true
+`
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  replicas: 3
+charts:
+  - name: glance
+    override:
+      $replace:
+        conf:
+          workers: 2
+        replicas: $(replicas)
+`, input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    conf:
+      workers: 2
+    replicas: 3
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      $replace:
+        replicas: 3
+      image: keystone
+`, input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "can not have the other paths with $replace") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestAllowEnvGlobals(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	for name, val := range map[string]string{
+		"CI_COMMIT_SHA": "0123abc",
+		"CI_REPLICAS":   "3",
+		"domain":        "env.example.com",
+	} {
+		os.Setenv(name, val)
+		defer os.Unsetenv(name)
+	}
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values: {}
+`
+	config := `
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+allowEnvGlobals: %t
+global:
+  domain: example.com
+charts:
+  - name: glance
+    override:
+      image.tag: $(CI_COMMIT_SHA)
+      replicas: $(CI_REPLICAS|int)
+      host: $(domain)
+`
+	rm := th.LoadAndRunTransformer(fmt.Sprintf(config, true), input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    host: example.com
+    image:
+      tag: 0123abc
+    replicas: 3
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(fmt.Sprintf(config, false), input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "$(CI_COMMIT_SHA)") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    namespace: tenant-a
+    override:
+      tenant: a
+  - name: glance
+    namespace: tenant-b
+    override:
+      tenant: b
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+  namespace: tenant-a
+spec:
+  chart:
+    version: 1.0.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+  namespace: tenant-b
+spec:
+  chart:
+    version: 1.0.0
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+  namespace: tenant-a
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    tenant: a
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+  namespace: tenant-b
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    tenant: b
+`)
+}
+
+func TestPatchError(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      conf:
+        $patch: unknown
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    conf:
+      debug: true
+`)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), `can not patch values of chart glance with {"spec":{"values":{"conf":{"$patch":"unknown"}}}}`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestYamlAnchorsInOverride(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      resources: &resources
+        limits:
+          cpu: 1
+          memory: 1Gi
+  - name: keystone
+    override:
+      resources:
+        <<: *resources
+        requests:
+          cpu: 0.5
+      api.resources: *resources
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    resources:
+      limits:
+        cpu: 1
+        memory: 1Gi
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    api:
+      resources:
+        limits:
+          cpu: 1
+          memory: 1Gi
+    resources:
+      limits:
+        cpu: 1
+        memory: 1Gi
+      requests:
+        cpu: 0.5
+`)
+}
+
+func TestEnabledChart(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+strict: true
+global:
+  enableMonitoring: false
+charts:
+  - name: prometheus
+    enabled: $(enableMonitoring)
+    source:
+      version: 2.0.0
+  - name: grafana
+    enabled: false
+  - name: glance
+    enabled: "true"
+    override:
+      replicas: 3
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: prometheus
+spec:
+  chart:
+    version: 1.0.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: prometheus
+spec:
+  chart:
+    version: 1.0.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 3
+`)
+}
+
+func TestGlobalVarFunctions(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values: {}
+`
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  branch: Feature_Login
+  region: " kr-central "
+charts:
+  - name: glance
+    override:
+      ingress.host: $(branch|lower|replace:_:-).example.com
+      region: $(region|trim|upper)
+`, input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    ingress:
+      host: feature-login.example.com
+    region: KR-CENTRAL
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  branch: main
+charts:
+  - name: glance
+    override:
+      ingress.host: $(branch|title)
+`, input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "unknown function title") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestGlobalVarBase64(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values: {}
+`
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  token: s3cr3t-token
+  encodedPassword: cGFzc3dvcmQ=
+  port: 8080
+charts:
+  - name: glance
+    override:
+      secrets.token: $(token|b64enc)
+      secrets.roundTrip: $(token|b64enc|b64dec)
+      secrets.password: $(encodedPassword|b64dec)
+      secrets.port: $(port|b64enc)
+`, input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    secrets:
+      password: password
+      port: ODA4MA==
+      roundTrip: s3cr3t-token
+      token: czNjcjN0LXRva2Vu
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  token: not-base64!
+charts:
+  - name: glance
+    override:
+      secrets.token: $(token|b64dec)
+`, input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "can not apply b64dec to $(token)") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestGlobalVarStringScalars(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  version: "01"
+  enabled: true
+  replicas: 3
+charts:
+  - name: glance
+    override:
+      image.tag: $(version)
+      image.version: $(version|string)
+      conf.enabled: $(enabled|string)
+      conf.replicas: $(replicas|string)
+      conf.default: $(undefined:-"007"|string)
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values: {}
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    conf:
+      default: "007"
+      enabled: "true"
+      replicas: "3"
+    image:
+      tag: "01"
+      version: "01"
+`)
+}
+
+func TestValuesPath(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+targetGvk:
+  group: platform.example.com
+  version: v1
+  kind: HelmApp
+valuesPath: spec.helmValues
+charts:
+  - name: glance
+    source:
+      version: 1.0.0
+    override:
+      image.tag: v2
+`, `
+apiVersion: platform.example.com/v1
+kind: HelmApp
+metadata:
+  name: glance
+spec:
+  helmValues:
+    image:
+      repository: glance
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: platform.example.com/v1
+kind: HelmApp
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  helmValues:
+    image:
+      repository: glance
+      tag: v2
+`)
+}
+
+// captureStderr returns what fn writes to stderr, which the logs of the transformer go to
+func captureStderr(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = stderr }()
+
+	fn()
+	w.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestWarnNoop(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	logs := captureStderr(t, func() {
+		th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+warnNoop: true
+global:
+  replicas: 3
+charts:
+  - name: glance
+    override:
+      replicas: $(replicas)
+      image.tag: v2
+      conf:
+        debug: true
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 3
+    image:
+      tag: v1
+    conf:
+      debug: true
+`)
+	})
+	for _, path := range []string{"replicas", "conf"} {
+		if !strings.Contains(logs, "Override "+path+" of chart glance does not change the value") {
+			t.Fatalf("expected a warning for %s: %s", path, logs)
+		}
+	}
+	if strings.Contains(logs, "Override image.tag") {
+		t.Fatalf("unexpected warning for image.tag: %s", logs)
+	}
+}
+
+func TestMergeListByKey(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      container.env(name):
+      - name: LOG_LEVEL
+        value: debug
+      - name: SIDECAR
+        value: enabled
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    container:
+      env:
+      - name: LOG_LEVEL
+        value: info
+      - name: REGION
+        value: kr
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    container:
+      env:
+      - name: LOG_LEVEL
+        value: debug
+      - name: REGION
+        value: kr
+      - name: SIDECAR
+        value: enabled
+`)
+}
+
+func TestDumpValuesDir(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	dumpDir := filepath.Join(t.TempDir(), "values")
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+dumpValuesDir: `+dumpDir+`
+charts:
+  - name: glance
+    override:
+      image.tag: v2
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    image:
+      repository: glance
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    image:
+      repository: glance
+      tag: v2
+`)
+
+	dumped, err := os.ReadFile(filepath.Join(dumpDir, "glance.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `image:
+  repository: glance
+  tag: v2
+`
+	if string(dumped) != expected {
+		t.Fatalf("expected values %q but got %q", expected, string(dumped))
+	}
+}
+
+func TestGlobalVarInterpolation(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values: {}
+`
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  ratio: 1.5
+  large: 10000000
+  labels:
+    app: glance
+  zones: [a, b]
+charts:
+  - name: glance
+    override:
+      ratio: $(ratio)
+      ratioName: ratio-$(ratio)
+      largeName: size-$(large)
+      labels: $(labels)
+      zones: $(zones)
+      nested:
+        labels: $(labels)
+        name: zone-$(ratio)
+`, input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    labels:
+      app: glance
+    largeName: size-10000000
+    nested:
+      labels:
+        app: glance
+      name: zone-1.5
+    ratio: 1.5
+    ratioName: ratio-1.5
+    zones:
+    - a
+    - b
+`)
+
+	for global, kind := range map[string]string{"labels": "map", "zones": "list"} {
+		err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  labels:
+    app: glance
+  zones: [a, b]
+charts:
+  - name: glance
+    override:
+      name: glance-$(`+global+`)
+`, input)
+		if err == nil {
+			t.Fatalf("expected an error")
+		}
+		if !strings.Contains(err.Error(), "can not interpolate "+kind+" global $("+global+") into a string") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestChartNameGlobal(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  registry: registry.example.com
+charts:
+  - name: glance
+    source:
+      name: $(chartName)
+      version: 1.2.3
+    override:
+      image.repository: $(registry)/$(chartName)
+  - name: keystone
+    globals:
+      chartName: identity
+    override:
+      image.repository: $(registry)/$(chartName)
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    name: glance
+    version: 1.2.3
+  values:
+    image:
+      repository: registry.example.com/glance
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    image:
+      repository: registry.example.com/identity
+`)
+}
+
+func TestOverridePathConflict(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values: {}
+`
+	for override, conflict := range map[string]string{
+		"conf.foo: 1\n      conf.foo.bar: 2":       "conf.foo and conf.foo.bar",
+		"conf.foo: 1\n      conf[\"foo\"]: 2":      "conf.foo and conf[\"foo\"]",
+		"conf.foo: $delete\n      conf.foo.bar: 2": "conf.foo and conf.foo.bar",
+	} {
+		err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      `+override+`
+`, input)
+		if err == nil {
+			t.Fatalf("expected an error")
+		}
+		if !strings.Contains(err.Error(), "override paths "+conflict+" conflict") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      conf.foo:
+        baz: 1
+      conf.foo.bar: 2
+`, input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    conf:
+      foo:
+        bar: 2
+        baz: 1
+`)
+}
+
+func TestChartNames(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+strict: %t
+charts:
+  - names: [glance, keystone, horizon]
+    override:
+      pod.replicas: 3
+`
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+`
+	rm := th.LoadAndRunTransformer(fmt.Sprintf(config, false), input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    pod:
+      replicas: 3
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    pod:
+      replicas: 3
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(fmt.Sprintf(config, true), input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "Can't find HelmRelease name: horizon") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestMalformedConfig(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	// the config which is not valid yaml fails to be read before the transformer,
+	// so it is malformed with the types of fields instead
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  name: glance
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+`)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "invalid config") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestChartReference(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: worker
+spec:
+  chart:
+    version: 1.0.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: api
+spec:
+  chart:
+    version: 1.0.0
+`
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  domain: example.com
+charts:
+  - name: worker
+    override:
+      config.apiUrl: https://$(@api.ingress.host)
+      config.apiPort: $(@api.service.port)
+      config.timeout: $(@api.timeout:-30)
+  - name: api
+    override:
+      ingress:
+        host: $(chartName).$(domain)
+      service.port: 8080
+`, input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: worker
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    config:
+      apiPort: 8080
+      apiUrl: https://api.example.com
+      timeout: 30
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: api
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    ingress:
+      host: api.example.com
+    service:
+      port: 8080
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: worker
+    override:
+      config.apiUrl: $(@api.url)
+  - name: api
+    override:
+      url: $(@worker.config.apiUrl)
+`, input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "Cycle in global variables: @api.url -> @worker.config.apiUrl -> @api.url") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestErrorClasses(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	// the sentinel errors are looked up from the plugin loaded by the harness
+	p, err := plugin.Open("HelmValuesTransformer.so")
+	if err != nil {
+		t.Fatalf("can not open plugin: %v", err)
+	}
+	lookupErr := func(name string) error {
+		sym, err := p.Lookup(name)
+		if err != nil {
+			t.Fatalf("can not find %s: %v", name, err)
+		}
+		return *sym.(*error)
+	}
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    image:
+      tag: 1.0.0
+`
+	for _, tc := range []struct {
+		class  string
+		config string
+	}{
+		{"ErrMissingRelease", `
+charts:
+  - name: keystone
+strict: true
+`},
+		{"ErrUndefinedGlobal", `
+charts:
+  - name: glance
+    override:
+      replicas: $(replicas)
+`},
+		{"ErrPatchFailed", `
+charts:
+  - name: glance
+    override:
+      image:
+        $patch: unknown
+`},
+	} {
+		err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+`+tc.config, input)
+		if err == nil {
+			t.Fatalf("expected an error of %s", tc.class)
+		}
+		if !errors.Is(err, lookupErr(tc.class)) {
+			t.Fatalf("expected an error of %s: %v", tc.class, err)
+		}
+	}
+}
+
+func TestVersionMap(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  openstackVersion: 1.2.3
+versionMap:
+  glance: $(openstackVersion)
+  keystone: 0.1.0
+charts:
+  - name: glance
+  - name: keystone
+    chartVersion: 0.2.0
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    name: glance
+    version: 1.0.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    name: keystone
+    version: 0.0.1
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    name: glance
+    version: 1.2.3
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    name: keystone
+    version: 0.2.0
+`)
+}
+
+func TestRawValues(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  env: prod
+charts:
+  - name: glance
+    rawValues: true
+    source:
+      version: $(version)
+    override:
+      command: echo $(env) $$(date)
+  - name: keystone
+    override:
+      command: echo $(env)
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: $(version)
+  values:
+    command: echo $(env) $$(date)
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    command: echo prod
+`)
+}
+
+func TestNestedGlobalVar(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  cluster:
+    region: kr
+    zone:
+      name: kr-1a
+  db.host: db.example.com
+charts:
+  - name: glance
+    override:
+      region: $(cluster.region)
+      zone: $(cluster.zone)
+      host: api.$(cluster.zone.name).example.com
+      db: $(db.host)
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    db: db.example.com
+    host: api.kr-1a.example.com
+    region: kr
+    zone:
+      name: kr-1a
+`)
+}
+
+func TestMaxPathDepth(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+`
+	config := `
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+maxPathDepth: %d
+charts:
+  - name: glance
+    override:
+      %s: true
+`
+	rm := th.LoadAndRunTransformer(fmt.Sprintf(config, 3, "conf.glance.debug"), input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    conf:
+      glance:
+        debug: true
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(fmt.Sprintf(config, 2, "conf.glance.debug"), input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "override path conf.glance.debug of chart glance is deeper than maxPathDepth 2") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = th.ErrorFromLoadAndRunTransformer(fmt.Sprintf(config, 0, strings.Repeat("a.", 64)+"a"), input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "is deeper than maxPathDepth 64") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestDependsOn(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values: {}
+`
+	reportPath := filepath.Join(t.TempDir(), "report.txt")
+	th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+report: true
+reportPath: `+reportPath+`
+charts:
+  - name: worker
+    dependsOn: [api, flux-system]
+  - name: cache
+  - name: api
+    dependsOn: [db]
+  - name: db
+`, input)
+	report, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `chart db: skipped without HelmRelease
+chart api: skipped without HelmRelease
+chart worker: skipped without HelmRelease
+chart cache: skipped without HelmRelease
+`
+	if string(report) != expected {
+		t.Fatalf("unexpected report: %s", report)
+	}
+
+	err = th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: worker
+    dependsOn: [api]
+  - name: api
+    dependsOn: [db]
+  - name: db
+    dependsOn: [worker]
+`, input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "Cycle in dependsOn of charts: worker -> api -> db -> worker") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestResolveGlobals(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	p, err := plugin.Open("HelmValuesTransformer.so")
+	if err != nil {
+		t.Fatalf("can not open plugin: %v", err)
+	}
+	sym, err := p.Lookup("ResolveGlobals")
+	if err != nil {
+		t.Fatalf("can not find ResolveGlobals: %v", err)
+	}
+	resolveGlobals := sym.(func(interface{}, map[string]interface{}) (interface{}, error))
+
+	globals := map[string]interface{}{
+		"domain":   "example.com",
+		"apiHost":  "api.$(domain)",
+		"replicas": 3,
+	}
+	resolved, err := resolveGlobals(map[string]interface{}{
+		"host":     "https://$(apiHost)",
+		"replicas": "$(replicas)",
+		"tags":     []interface{}{"$(env:-prod)"},
+	}, globals)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(resolved) != "map[host:https://api.example.com replicas:3 tags:[prod]]" {
+		t.Fatalf("unexpected value: %v", resolved)
+	}
+
+	_, err = resolveGlobals("$(undefined)", globals)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "Can not found global variable named $(undefined)") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the other charts are undefined without the plugin
+	_, err = resolveGlobals("$(@api.ingress.host)", globals)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "Can not found global variable named $(@api.ingress.host)") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sym, err = p.Lookup("ResolveGlobalsWith")
+	if err != nil {
+		t.Fatalf("can not find ResolveGlobalsWith: %v", err)
+	}
+	resolveGlobalsWith := sym.(func(interface{}, map[string]interface{}, bool, string, bool) (interface{}, error))
+	os.Setenv("RESOLVE_GLOBALS_ENV", "from-env")
+	defer os.Unsetenv("RESOLVE_GLOBALS_ENV")
+	resolved, err = resolveGlobalsWith([]interface{}{"$(undefined)", "$(RESOLVE_GLOBALS_ENV)", "$(empty:-default)"},
+		map[string]interface{}{"empty": ""}, true, "keep", true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(resolved) != "[$(undefined) from-env default]" {
+		t.Fatalf("unexpected value: %v", resolved)
+	}
+}
+
+func TestMissingValues(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+mergeValues: %t
+charts:
+  - name: glance
+    override:
+      conf.debug: true
+      extraEnv[]: [{name: DEBUG, value: "true"}]
+      env(name): [{name: LOG_LEVEL, value: debug}]
+      ingress: $delete
+`
+	for _, mergeValues := range []bool{false, true} {
+		for _, values := range []string{"", "\n  values: null", "\n  values: ~"} {
+			rm := th.LoadAndRunTransformer(fmt.Sprintf(config, mergeValues), `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0`+values+`
+`)
+			th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    conf:
+      debug: true
+    env:
+    - name: LOG_LEVEL
+      value: debug
+    extraEnv:
+    - name: DEBUG
+      value: "true"
+`)
+		}
+	}
+}
+
+func TestGlobalsFromPrefix(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	th.WriteF("globals/base.yaml", `
+registry: docker.io
+`)
+	th.WriteF("globals/storage.yaml", `
+registry: storage.example.com
+pool: rbd
+`)
+	th.WriteF("globals/network.yaml", `
+registry: network.example.com
+`)
+	th.WriteF("globals/storage-site.yaml", `
+pool: images
+`)
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+`
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+globalsFrom:
+  - globals/base.yaml
+  - path: globals/storage.yaml
+    prefix: storage
+  - path: globals/network.yaml
+    prefix: network
+charts:
+  - name: glance
+    override:
+      images: [$(registry), $(storage.registry), $(network.registry)]
+      conf.pool: $(storage.pool)
+`, input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    conf:
+      pool: rbd
+    images:
+    - docker.io
+    - storage.example.com
+    - network.example.com
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+globalsFrom:
+  - path: globals/storage.yaml
+    prefix: storage
+  - path: globals/storage-site.yaml
+    prefix: storage
+charts:
+  - name: glance
+`, input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "global variable storage.pool is defined in both globalsFrom globals/storage.yaml and globals/storage-site.yaml") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRootPathOverride(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+mergeValues: %t
+global:
+  team: storage
+charts:
+  - name: glance
+    override:
+      /metadata.labels.team: $(team)
+      /metadata.annotations.deprecated: $delete
+      /spec.interval: 5m
+      conf.debug: true
+`
+	for _, mergeValues := range []bool{false, true} {
+		rm := th.LoadAndRunTransformer(fmt.Sprintf(config, mergeValues), `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+  annotations:
+    deprecated: "true"
+    owner: storage-team
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    conf:
+      debug: false
+`)
+		th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  annotations:
+    owner: storage-team
+  labels:
+    team: storage
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  interval: 5m
+  values:
+    conf:
+      debug: true
+`)
+	}
+}
+
+func TestGlobalsFromDocuments(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	th.WriteF("globals/site.yaml", `---
+registry: docker.io
+tag: latest
+replicas: 1
+---
+tag: taco-0.1.0
+---
+replicas: 3
+`)
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+globalsFrom:
+  - globals/site.yaml
+charts:
+  - name: glance
+    override:
+      image: $(registry)/glance:$(tag)
+      replicas: $(replicas)
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    image: docker.io/glance:taco-0.1.0
+    replicas: 3
+`)
+}
+
+func TestStrictConfig(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+`
+	config := `
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+strictConfig: %t
+charts:
+  - name: glance
+    overide:
+      conf.debug: true
+`
+	rm := th.LoadAndRunTransformer(fmt.Sprintf(config, false), input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(fmt.Sprintf(config, true), input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), `invalid config: json: unknown field "overide"`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the entries of globalsFrom unmarshal themselves, but they are checked as well
+	th.WriteF("globals.yaml", `
+env: prod
+`)
+	err = th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+strictConfig: true
+globalsFrom:
+  - globals.yaml
+  - pth: globals.yaml
+    prefix: site
+charts:
+  - name: glance
+`, input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), `invalid config: globalsFrom.1: json: unknown field "pth"`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRefOverride(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+`
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  domain: example.com
+charts:
+  - name: glance
+    override:
+      ingress.host: glance.$(domain)
+      ingress.tls[0].hosts[0]: {$ref: ingress.host}
+      conf.publicEndpoint: {$ref: ingress.tls.0.hosts.0}
+      conf.ingress: {$ref: ingress}
+`, input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    conf:
+      ingress:
+        host: glance.example.com
+        tls:
+        - hosts:
+          - glance.example.com
+      publicEndpoint: glance.example.com
+    ingress:
+      host: glance.example.com
+      tls:
+      - hosts:
+        - glance.example.com
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      conf.publicEndpoint: {$ref: ingress.host}
+`, input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "$ref ingress.host of override conf.publicEndpoint of chart glance does not exist") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestTraceSubstitution(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+logLevel: %s
+global:
+  env: prod
+  replicas: 3
+charts:
+  - name: glance
+    source:
+      version: $(env)-1.0.0
+    override:
+      replicas: $(replicas)
+      ingress.$(env).host: glance.$(env).example.com
+      image.tag: latest
+`
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+`
+	logs := captureStderr(t, func() {
+		th.LoadAndRunTransformer(fmt.Sprintf(config, "trace"), input)
+	})
+	for _, log := range []string{
+		"[TRACE] chart glance path source.version: $(env)-1.0.0 -> prod-1.0.0",
+		"[TRACE] chart glance path override.replicas: $(replicas) -> 3",
+		"[TRACE] chart glance path override: ingress.$(env).host -> ingress.prod.host",
+		"[TRACE] chart glance path override.ingress.$(env).host: glance.$(env).example.com -> glance.prod.example.com",
+	} {
+		if !strings.Contains(logs, log) {
+			t.Fatalf("expected a log %s: %s", log, logs)
+		}
+	}
+	if strings.Contains(logs, "override.image.tag") {
+		t.Fatalf("unexpected log for image.tag: %s", logs)
+	}
+
+	logs = captureStderr(t, func() {
+		th.LoadAndRunTransformer(fmt.Sprintf(config, "debug"), input)
+	})
+	if strings.Contains(logs, "[TRACE]") {
+		t.Fatalf("unexpected trace logs: %s", logs)
+	}
+}
+
+func TestReleaseNameAndTargetNamespace(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  tenant: tenant-a
+charts:
+  - name: glance
+    releaseName: $(tenant)-$(chartName)
+    targetNamespace: $(tenant)
+    override:
+      replicas: 3
+`, `
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  releaseName: glance
+  chart:
+    spec:
+      chart: glance
+      version: 1.0.0
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    spec:
+      chart: glance
+      version: 1.0.0
+  releaseName: tenant-a-glance
+  targetNamespace: tenant-a
+  values:
+    replicas: 3
+`)
+}
+
+func TestVerifyIdempotent(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    extraEnv:
+    - name: LOG_LEVEL
+      value: info
+`
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+verifyIdempotent: true
+charts:
+  - name: glance
+    override:
+      replicas: 3
+      extraEnv(name): [{name: LOG_LEVEL, value: debug}]
+`, input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    extraEnv:
+    - name: LOG_LEVEL
+      value: debug
+    replicas: 3
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+verifyIdempotent: true
+charts:
+  - name: glance
+    override:
+      extraEnv[]: [{name: DEBUG, value: "true"}]
+`, input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "chart glance is not idempotent, HelmRelease glance differs when patched again") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestReleaseGlobals(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    namespace: openstack
+    override:
+      ingress.host: $(releaseName).$(releaseNamespace).example.com
+  - name: keystone
+    namespace: openstack
+    globals:
+      releaseNamespace: identity
+    override:
+      ingress.host: $(releaseName).$(releaseNamespace).example.com
+  - name: cinder
+    override:
+      ingress.host: $(releaseName).$(releaseNamespace:-default).example.com
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+  namespace: openstack
+spec:
+  chart:
+    version: 1.0.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+  namespace: openstack
+spec:
+  chart:
+    version: 1.0.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: cinder
+spec:
+  chart:
+    version: 1.0.0
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+  namespace: openstack
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    ingress:
+      host: glance.openstack.example.com
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+  namespace: openstack
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    ingress:
+      host: keystone.identity.example.com
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: cinder
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    ingress:
+      host: cinder.default.example.com
+`)
+}
+
+func TestFileOverride(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	th.WriteF("files/tls.crt", `-----BEGIN CERTIFICATE-----
+MIIB
+-----END CERTIFICATE-----
+`)
+	th.WriteF("files/prod/resources.yaml", `
+limits:
+  cpu: 2
+  memory: 1Gi
+`)
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+`
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  env: prod
+charts:
+  - name: glance
+    override:
+      tls.crt: {$file: files/tls.crt}
+      resources: {$fileYaml: files/$(env)/resources.yaml}
+`, input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    resources:
+      limits:
+        cpu: 2
+        memory: 1Gi
+    tls:
+      crt: |
+        -----BEGIN CERTIFICATE-----
+        MIIB
+        -----END CERTIFICATE-----
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      tls.crt: {$file: files/missing.crt}
+`, input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "invalid override tls.crt of chart glance: can not read $file files/missing.crt") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the documents of a file are merged in order, while they must be mappings
+	th.WriteF("files/resources.yaml", `
+limits:
+  cpu: 1
+  memory: 1Gi
+---
+limits:
+  cpu: 2
+requests:
+  cpu: 1
+`)
+	th.WriteF("files/list.yaml", `
+- cpu
+---
+- memory
+`)
+	rm = th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      resources: {$fileYaml: files/resources.yaml}
+`, input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    resources:
+      limits:
+        cpu: 2
+        memory: 1Gi
+      requests:
+        cpu: 1
+`)
+
+	err = th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      resources: {$fileYaml: files/list.yaml}
+`, input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "can not parse $fileYaml files/list.yaml, whose documents must be mappings") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCollectErrors(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm, err := th.RunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+errorMode: collect
+strict: true
+charts:
+  - name: glance
+    override:
+      conf:
+        $patch: unknown
+  - name: horizon
+  - name: keystone
+    override:
+      replicas: 3
+  - name: cinder
+    override:
+      image: $(registry)
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: cinder
+spec:
+  chart:
+    version: 1.0.0
+`)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	for _, msg := range []string{
+		"chart glance: can not patch values of chart glance",
+		"chart horizon: Can't find HelmRelease name: horizon",
+		"Can not found global variable named $(registry) in chart cinder at override.image",
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 3
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: cinder
+spec:
+  chart:
+    version: 1.0.0
+`)
+}
+
+func TestNegativeIndexOverride(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    containers:
+    - name: api
+      image: glance:v1
+    - name: sidecar
+      image: sidecar:v1
+`
+	config := `
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      %s
+`
+	rm := th.LoadAndRunTransformer(fmt.Sprintf(config, "containers.-1.image: sidecar:v2\n      containers.-2.image: glance:v2"), input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    containers:
+    - image: glance:v2
+      name: api
+    - image: sidecar:v2
+      name: sidecar
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(fmt.Sprintf(config, "containers.-3.image: sidecar:v2"), input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "index -3 is out of range of list of 2 items") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func BenchmarkResolveGlobals(b *testing.B) {
+	// the harness requires *testing.T, which only reports the failures to build the plugin
+	th := kusttest_test.MakeEnhancedHarness(&testing.T{}).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	p, err := plugin.Open("HelmValuesTransformer.so")
+	if err != nil {
+		b.Fatal(err)
+	}
+	sym, err := p.Lookup("ResolveGlobals")
+	if err != nil {
+		b.Fatal(err)
+	}
+	resolveGlobals := sym.(func(interface{}, map[string]interface{}) (interface{}, error))
+
+	globals := map[string]interface{}{
+		"registry": "registry.example.com",
+		"tag":      "v1.0.0",
+		"domain":   "example.com",
+	}
+	values := map[string]interface{}{}
+	for i := 0; i < 1000; i++ {
+		values[fmt.Sprintf("image%d", i)] = "$(registry)/image:$(tag)"
+		values[fmt.Sprintf("host%d", i)] = "api.$(domain)"
+		values[fmt.Sprintf("plain%d", i)] = "no global variables"
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = resolveGlobals(values, globals); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestForEach(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  domain: example.com
+charts:
+  - name: app-$(region)
+    globals:
+      replicas: 1
+    forEach:
+      - region: kr
+        replicas: 3
+      - region: us
+    override:
+      region: $(region)
+      replicas: $(replicas)
+      ingress.host: $(chartName).$(domain)
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: app-kr
+spec:
+  chart:
+    version: 1.0.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: app-us
+spec:
+  chart:
+    version: 1.0.0
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: app-kr
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    ingress:
+      host: app-kr.example.com
+    region: kr
+    replicas: 3
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: app-us
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    ingress:
+      host: app-us.example.com
+    region: us
+    replicas: 1
+`)
+}
+
+func TestSourceRefPattern(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    spec:
+      chart: glance
+      version: 1.0.0
+`
+	config := `
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+sourceRefPattern: ^HelmRepository/flux-system/[a-z-]+$
+global:
+  repository: openinfradev
+charts:
+  - name: glance
+    sourceRef:
+      kind: HelmRepository
+      name: $(repository)
+      %s
+`
+	rm := th.LoadAndRunTransformer(fmt.Sprintf(config, "namespace: flux-system"), input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    spec:
+      chart: glance
+      sourceRef:
+        kind: HelmRepository
+        name: openinfradev
+        namespace: flux-system
+      version: 1.0.0
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(fmt.Sprintf(config, ""), input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "sourceRef HelmRepository/openinfradev of chart glance does not match sourceRefPattern") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the ref made of source is checked as well, and the repository of Flux v1
+	sourceConfig := `
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+sourceRefPattern: ^HelmRepository/trusted$|^https://charts\.example\.com/
+charts:
+  - name: glance
+    source:
+      repository: evil
+      type: helmrepo
+`
+	err = th.ErrorFromLoadAndRunTransformer(sourceConfig, input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "sourceRef HelmRepository/evil of chart glance does not match sourceRefPattern") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = th.ErrorFromLoadAndRunTransformer(sourceConfig, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    repository: https://charts.example.com/stable
+    name: glance
+    version: 1.0.0
+`)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "repository evil of chart glance does not match sourceRefPattern") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rm = th.LoadAndRunTransformer(strings.Replace(sourceConfig, "repository: evil", "repository: https://charts.example.com/prod", 1), `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    repository: https://charts.example.com/stable
+    name: glance
+    version: 1.0.0
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    name: glance
+    repository: https://charts.example.com/prod
+    type: helmrepo
+    version: 1.0.0
+`)
+}
+
+func TestDeletePaths(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  backend: ceph
+charts:
+  - name: glance
+    delete:
+      - storage.$(backend)
+      - endpoints.0
+      - missing.path
+    override:
+      storage.file.path: /var/lib/glance
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values:
+    storage:
+      ceph:
+        pool: images
+        user: glance
+      file:
+        path: /tmp
+    endpoints:
+      - internal
+      - public
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart: {}
+  values:
+    endpoints:
+    - public
+    storage:
+      file:
+        path: /var/lib/glance
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+strict: true
+charts:
+  - name: glance
+    delete:
+      - missing.path
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values:
+    storage: {}
+`)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "delete path missing.path of chart glance does not exist") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the indices refer to the values before the removal, even under strict
+	rm = th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+strict: true
+charts:
+  - name: glance
+    delete:
+      - ports.0
+      - ports.1
+      - ports.-1
+      - containers.0.env.0
+      - containers.0.image
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values:
+    ports: [80, 443, 8080, 9090]
+    containers:
+    - name: api
+      image: glance:1.0.0
+      env: [DEBUG, VERBOSE]
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart: {}
+  values:
+    containers:
+    - env:
+      - VERBOSE
+      name: api
+    ports:
+    - 8080
+`)
+}
+
+func TestPreserveComments(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	// the resources are read as the KRM function does, since the harness drops the comments
+	nodes, err := kyaml.Parse(`
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  # the chart is pinned
+  chart:
+    version: 1.0.0
+  values:
+    # the pods of glance
+    replicas: 1
+    storage:
+      # the backend of images
+      backend: file
+      path: /var/lib/glance # path of the file backend
+    endpoints:
+      - name: public
+        port: 9292
+    debug: true
+    annotations: {}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := resmap.NewFactory(provider.NewDefaultDepProvider().GetResourceFactory()).
+		NewResMapFromRNodeSlice([]*kyaml.RNode{nodes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm, err := th.RunTransformerFromResMap(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    delete:
+      - debug
+    override:
+      replicas: 3
+      storage.backend: ceph
+      endpoints.0.port: 9293
+`, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := rm.Resources()[0].RNode.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  # the chart is pinned
+  chart:
+    version: 1.0.0
+  values:
+    # the pods of glance
+    replicas: 3
+    storage:
+      # the backend of images
+      backend: ceph
+      path: /var/lib/glance # path of the file backend
+    endpoints:
+    - name: public
+      port: 9293
+    annotations: {}
+`
+	if actual != expected {
+		t.Fatalf("expected:\n%s\nactual:\n%s", expected, actual)
+	}
+}
+
+func TestOutputChangedOnly(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 1
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 2
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+`
+	config := `
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+outputChangedOnly: true
+dryRun: %t
+charts:
+  - name: glance
+    chartVersion: 1.0.0
+    override:
+      replicas: 3
+  - name: keystone
+    chartVersion: 1.0.0
+    override:
+      replicas: 2
+`
+	rm := th.LoadAndRunTransformer(fmt.Sprintf(config, false), input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 3
+`)
+
+	rm = th.LoadAndRunTransformer(fmt.Sprintf(config, true), input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 1
+`)
+}
+
+func TestNumericPathSegments(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    ports:
+      "9090":
+        protocol: UDP
+    containers:
+      - image: glance:1.0.0
+`
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      ports.8080.protocol: TCP
+      ports.9090.protocol: TCP
+      containers.0.image: glance:2.0.0
+      args[0]: --debug
+      hosts.[1].name: glance.example.com
+`, input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    args:
+    - --debug
+    containers:
+    - image: glance:2.0.0
+    hosts:
+    - null
+    - name: glance.example.com
+    ports:
+      "8080":
+        protocol: TCP
+      "9090":
+        protocol: TCP
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      ports[0].protocol: TCP
+`, input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "can not index [0] into map") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestJSONLogs(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	logs := captureStderr(t, func() {
+		th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+logFormat: json
+warnNoop: true
+charts:
+  - name: glance
+    override:
+      replicas: 1
+  - name: keystone
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values:
+    replicas: 1
+`)
+	})
+	var entries []map[string]string
+	for _, line := range strings.Split(strings.TrimSpace(logs), "\n") {
+		entry := map[string]string{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log is not json: %s", line)
+		}
+		delete(entry, "caller")
+		entries = append(entries, entry)
+	}
+	expected := []map[string]string{
+		{"level": "warn", "message": "Override replicas of chart glance does not change the value", "chart": "glance", "path": "replicas"},
+		{"level": "warn", "message": "Can't find HelmRelease name: keystone", "chart": "keystone"},
+		{"level": "info", "message": "Skipped 1 of 2 charts without HelmRelease"},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("expected %v, but got %v", expected, entries)
+	}
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+logFormat: xml
+charts: []
+`, "")
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "unknown logFormat xml") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateOnly(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  values:
+    replicas: 1
+`
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+validateOnly: true
+global:
+  replicas: 3
+charts:
+  - name: glance
+    override:
+      replicas: $(replicas)
+  - name: keystone
+    override:
+      replicas: $(replicas)
+`, input)
+	th.AssertActualEqualsExpected(rm, input)
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+validateOnly: true
+charts:
+  - name: glance
+    override:
+      conf.ceph: disabled
+      conf.ceph.enabled: true
+  - name: keystone
+    override:
+      replicas: $(replicas)
+  - name: cinder
+    enabled: false
+    override:
+      replicas: $(replicas)
+`, "")
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	for _, msg := range []string{
+		"override paths conf.ceph and conf.ceph.enabled conflict",
+		"$(replicas) in chart keystone at override.replicas",
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if strings.Contains(err.Error(), "cinder") {
+		t.Fatalf("unexpected error of disabled chart: %v", err)
+	}
+}
+
+func TestFluxV2ChartSource(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: keystone
+    source:
+      repository: https://openinfradev.github.io/helm-repo
+      name: keystone-$(releaseName)
+      version: 0.2.0
+    sourceRef:
+      kind: HelmRepository
+      name: openinfradev
+      namespace: flux-system
+  - name: glance
+    source:
+      repository: https://openinfradev.github.io/helm-repo
+      name: glance
+      version: 0.2.0
+`, `
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    spec:
+      chart: keystone
+      version: 0.1.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    name: glance
+    version: 0.1.0
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    spec:
+      chart: keystone-keystone
+      sourceRef:
+        kind: HelmRepository
+        name: openinfradev
+        namespace: flux-system
+      version: 0.2.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    name: glance
+    repository: https://openinfradev.github.io/helm-repo
+    version: 0.2.0
+`)
+}
+
+func TestListItems(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	// the resources are read as the KRM function does, since the harness inlines the items of List
+	var nodes []*kyaml.RNode
+	for _, input := range []string{`
+apiVersion: v1
+kind: List
+items:
+  - apiVersion: helm.fluxcd.io/v1
+    kind: HelmRelease
+    metadata:
+      name: glance
+    spec:
+      chart:
+        version: 1.0.0
+      values:
+        replicas: 1
+  - apiVersion: v1
+    kind: ConfigMap
+    metadata:
+      name: glance
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 1
+`} {
+		node, err := kyaml.Parse(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+	m, err := resmap.NewFactory(provider.NewDefaultDepProvider().GetResourceFactory()).
+		NewResMapFromRNodeSlice(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm, err := th.RunTransformerFromResMap(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      replicas: 3
+  - name: keystone
+    override:
+      replicas: 2
+`, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+items:
+- apiVersion: helm.fluxcd.io/v1
+  kind: HelmRelease
+  metadata:
+    name: glance
+  spec:
+    chart:
+      version: 1.0.0
+    values:
+      replicas: 3
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: glance
+kind: List
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 2
+`)
+}
+
+func TestGoTemplate(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+`
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  env: prod
+  replicas: 3
+  cluster:
+    region: kr
+  zones: [a, b]
+charts:
+  - name: glance
+    goTemplate: true
+    override:
+      ingress.host: "{{ .chartName }}.{{ .cluster.region }}.example.com"
+      conf.env: '{{ if eq .env "prod" }}production{{ else }}staging{{ end }}'
+      conf.zones: "{{ range $i, $z := .zones }}{{ if $i }},{{ end }}{{ upper $z }}{{ end }}"
+      conf.pods: "{{ .env }}-$(replicas)"
+      conf.debug: '{{ default "false" (index . "debug") }}'
+      conf.literal: '{{ "{{" }} raw }}'
+  - name: keystone
+    override:
+      conf.literal: "{{ .env }}"
+`, input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    conf:
+      debug: "false"
+      env: production
+      literal: '{{ raw }}'
+      pods: prod-3
+      zones: A,B
+    ingress:
+      host: glance.kr.example.com
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    conf:
+      literal: '{{ .env }}'
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    goTemplate: true
+    override:
+      conf.env: "{{ .env }}"
+`, input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "invalid template of override conf.env of chart glance") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSetIfAbsent(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  replicas: 3
+commonOverride:
+  replicas?: $(replicas)
+  conf.debug?: false
+  conf.logLevel?: info
+charts:
+  - name: glance
+  - name: keystone
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 1
+    conf:
+      debug: null
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    conf:
+      logLevel: debug
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    conf:
+      debug: false
+      logLevel: info
+    replicas: 1
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    conf:
+      debug: false
+      logLevel: debug
+    replicas: 3
+`)
+}
+
+func TestGlobalProfiles(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  env: dev
+  replicas: 1
+  db:
+    host: db.dev
+    port: 5432
+globalProfiles:
+  prod:
+    env: prod
+    replicas: 3
+    db:
+      host: db.prod
+activeProfile: %s
+charts:
+  - name: glance
+    override:
+      env: $(env)
+      replicas: $(replicas)
+      db: $(db.host):$(db.port)
+`
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+`
+	os.Setenv("HELM_VALUES_PROFILE", "prod")
+	defer os.Unsetenv("HELM_VALUES_PROFILE")
+	for _, activeProfile := range []string{"prod", "$(HELM_VALUES_PROFILE)"} {
+		rm := th.LoadAndRunTransformer(fmt.Sprintf(config, activeProfile), input)
+		th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    db: db.prod:5432
+    env: prod
+    replicas: 3
+`)
+	}
+
+	rm := th.LoadAndRunTransformer(fmt.Sprintf(config, `""`), input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    db: db.dev:5432
+    env: dev
+    replicas: 1
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(fmt.Sprintf(config, "stage"), input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "unknown activeProfile stage") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestTransformStats(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	// the plugin is run directly, since the harness runs a copy of it
+	p, err := plugin.Open("HelmValuesTransformer.so")
+	if err != nil {
+		t.Fatalf("can not open plugin: %v", err)
+	}
+	sym, err := p.Lookup("KustomizePlugin")
+	if err != nil {
+		t.Fatalf("can not find KustomizePlugin: %v", err)
+	}
+	depProvider := provider.NewDefaultDepProvider()
+	rmF := resmap.NewFactory(depProvider.GetResourceFactory())
+	h := resmap.NewPluginHelpers(
+		loader.NewFileLoaderAtCwd(filesys.MakeFsOnDisk()),
+		depProvider.GetFieldValidator(), rmF, types.DisabledPluginConfig())
+	if err = sym.(resmap.Configurable).Config(h, []byte(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  env: prod
+  replicas: 3
+charts:
+  - name: glance
+    override:
+      env: $(env)
+      replicas: $(replicas)
+  - name: keystone
+    override:
+      env: $(env)
+  - name: cinder
+    enabled: false
+  - name: nova
+`)); err != nil {
+		t.Fatal(err)
+	}
+	m, err := rmF.NewResMapFromBytes([]byte(`
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sym.(resmap.Transformer).Transform(m); err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(reflect.ValueOf(sym).MethodByName("Stats").Call(nil)[0].Interface())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := map[string]int{}
+	if err = json.Unmarshal(b, &stats); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int{"charts": 2, "skippedCharts": 2, "releases": 2, "substitutions": 3, "paths": 3}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Fatalf("expected %v, but got %v", expected, stats)
+	}
+}
+
+func TestWildcardOverride(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    containers:
+      - name: api
+        image: glance:1.0.0
+      - name: registry
+        image: glance-registry:1.0.0
+    pod:
+      api:
+        replicas: 1
+      registry:
+        replicas: 1
+`
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      containers.*.imagePullPolicy: Always
+      pod.*.replicas: 3
+      sidecars.*.image: busybox
+`, input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    containers:
+    - image: glance:1.0.0
+      imagePullPolicy: Always
+      name: api
+    - image: glance-registry:1.0.0
+      imagePullPolicy: Always
+      name: registry
+    pod:
+      api:
+        replicas: 3
+      registry:
+        replicas: 3
+`)
+
+	// the items are deleted from the last, so the indices do not shift
+	rm = th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      containers.*: $delete
+      pod.*.replicas: $delete
+`, input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    containers: []
+    pod:
+      api: {}
+      registry: {}
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+strict: true
+charts:
+  - name: glance
+    override:
+      sidecars.*.image: busybox
+`, input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "wildcard override path sidecars.*.image of chart glance matches nothing") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestBOMAndCRLF(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	// the plugin is configured directly, since the harness parses the config before the plugin
+	p, err := plugin.Open("HelmValuesTransformer.so")
+	if err != nil {
+		t.Fatalf("can not open plugin: %v", err)
+	}
+	sym, err := p.Lookup("KustomizePlugin")
+	if err != nil {
+		t.Fatalf("can not find KustomizePlugin: %v", err)
+	}
+	crlf := func(s string) []byte {
+		return []byte("\xef\xbb\xbf" + strings.ReplaceAll(s, "\n", "\r\n"))
+	}
+	fSys := filesys.MakeFsInMemory()
+	if err = fSys.WriteFile("/globals.yaml", crlf("region: kr\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err = fSys.WriteFile("/motd", crlf("welcome\nto glance\n")); err != nil {
+		t.Fatal(err)
+	}
+	depProvider := provider.NewDefaultDepProvider()
+	rmF := resmap.NewFactory(depProvider.GetResourceFactory())
+	h := resmap.NewPluginHelpers(
+		loader.NewFileLoaderAtRoot(fSys),
+		depProvider.GetFieldValidator(), rmF, types.DisabledPluginConfig())
+	if err = sym.(resmap.Configurable).Config(h, crlf(`apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+globalsFrom:
+  - /globals.yaml
+global:
+  env: prod
+charts:
+  - name: glance
+    override:
+      region: $(region)
+      motd: {$file: /motd}
+      command: |
+        echo $(env)
+        echo done
+`)); err != nil {
+		t.Fatal(err)
+	}
+	m, err := rmF.NewResMapFromBytes([]byte(`
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sym.(resmap.Transformer).Transform(m); err != nil {
+		t.Fatal(err)
+	}
+	th.AssertActualEqualsExpected(m, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    command: |
+      echo prod
+      echo done
+    motd: |
+      welcome
+      to glance
+    region: kr
+`)
+}
+
+func TestOverridePrecedence(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	// chart override > commonOverride > the existing values
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  common: common
+  chart: chart
+commonOverride:
+  replicas: 2
+  conf.debug: $(common)
+  conf.logLevel: $(common)
+  image.tag: $(common)
+charts:
+  - name: glance
+    override:
+      replicas: 3
+      conf:
+        debug: $(chart)
+      image: $(chart)
+  - name: keystone
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 1
+    conf:
+      timeout: 30
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 1
+    conf:
+      timeout: 30
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    conf:
+      debug: chart
+      logLevel: common
+      timeout: 30
+    image: chart
+    replicas: 3
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    conf:
+      debug: common
+      logLevel: common
+      timeout: 30
+    image:
+      tag: common
+    replicas: 2
+`)
+
+	// a default of commonOverride with "?" loses to the chart path, and so does a common path to the chart default
+	rm = th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+commonOverride:
+  replicas?: 3
+  image.tag: common
+charts:
+  - name: glance
+    override:
+      replicas: 5
+  - name: keystone
+  - name: cinder
+    override:
+      image.tag?: chart
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: cinder
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    image:
+      tag: existing
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    image:
+      tag: common
+    replicas: 5
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    image:
+      tag: common
+    replicas: 3
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: cinder
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    image:
+      tag: existing
+    replicas: 3
+`)
+}
+
+func TestSkipKey(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+skipKey: example.com/skip
+charts:
+  - names: [glance, keystone, nova]
+    override:
+      replicas: 3
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+  annotations:
+    example.com/skip: "true"
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 1
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+  labels:
+    example.com/skip: "true"
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 1
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: nova
+  annotations:
+    example.com/skip: "false"
+    transformer.openinfradev/skip: "true"
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 1
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  annotations:
+    example.com/skip: "true"
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 1
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  labels:
+    example.com/skip: "true"
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 1
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  annotations:
+    example.com/skip: "false"
+    transformer.openinfradev/skip: "true"
+  name: nova
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 3
+`)
+}
+
+func TestPatchStrategy(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    patchStrategy: json
+    override:
+      sidecars[1].image: proxy:2.0
+      conf.debug: $delete
+      conf.a/b~c: 1
+  - name: keystone
+    patchStrategy: merge
+    override:
+      conf.debug: true
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    sidecars:
+      - name: log
+        image: log:1.0
+      - name: proxy
+        image: proxy:1.0
+    conf:
+      debug: false
+      timeout: 30
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    conf:
+      timeout: 30
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    conf:
+      a/b~c: 1
+      timeout: 30
+    sidecars:
+    - image: log:1.0
+      name: log
+    - image: proxy:2.0
+      name: proxy
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    conf:
+      debug: true
+      timeout: 30
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    patchStrategy: replace
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+`)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "unknown patchStrategy replace of chart glance") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestChartRefWithoutOverride(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    source:
+      repository: https://openinfradev.github.io/dev-charts
+      version: 1.1.0-dev
+  - name: keystone
+    sourceRef:
+      kind: HelmRepository
+      name: openinfradev-dev
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    repository: https://openinfradev.github.io/helm-charts
+    name: glance
+    version: 1.0.0
+---
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    spec:
+      chart: keystone
+      sourceRef:
+        kind: HelmRepository
+        name: openinfradev
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    name: glance
+    repository: https://openinfradev.github.io/dev-charts
+    version: 1.1.0-dev
+---
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    spec:
+      chart: keystone
+      sourceRef:
+        kind: HelmRepository
+        name: openinfradev-dev
+`)
+}
+
+func TestChartsFromEnv(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+chartsFromEnv: HELM_VALUES_CHARTS
+charts:
+  - name: glance
+    override:
+      replicas: 3
+  - name: keystone
+    override:
+      replicas: 3
+  - name: nova
+    override:
+      replicas: 3
+`
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: nova
+spec:
+  chart:
+    version: 1.0.0
+`
+	os.Setenv("HELM_VALUES_CHARTS", " glance, nova ,")
+	rm := th.LoadAndRunTransformer(config, input)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 3
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    version: 1.0.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: nova
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 3
+`)
+
+	// all the charts are transformed without the environment variable
+	os.Unsetenv("HELM_VALUES_CHARTS")
+	rm = th.LoadAndRunTransformer(config, input)
+	for _, r := range rm.Resources() {
+		values, err := r.GetFieldValue("spec.values.replicas")
+		if err != nil || values != 3 {
+			t.Fatalf("unexpected replicas of %s: %v %v", r.GetName(), values, err)
+		}
+	}
+}
+
+func TestGlobalVarInChartName(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  env: prod
+charts:
+  - name: glance-$(env)
+    override:
+      replicas: 3
+  - name: keystone-$(region)
+    globals:
+      region: east
+    override:
+      replicas: 2
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance-prod
+spec:
+  chart:
+    version: 1.0.0
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone-east
+spec:
+  chart:
+    version: 1.0.0
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance-prod
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 3
+---
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: keystone-east
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 2
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance-$(env)
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance-prod
+spec:
+  chart:
+    version: 1.0.0
+`)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "invalid name of chart glance-$(env)") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestTransformContext(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	// the plugin is run directly, since the harness calls Transform only
+	p, err := plugin.Open("HelmValuesTransformer.so")
+	if err != nil {
+		t.Fatalf("can not open plugin: %v", err)
+	}
+	sym, err := p.Lookup("KustomizePlugin")
+	if err != nil {
+		t.Fatalf("can not find KustomizePlugin: %v", err)
+	}
+	depProvider := provider.NewDefaultDepProvider()
+	rmF := resmap.NewFactory(depProvider.GetResourceFactory())
+	h := resmap.NewPluginHelpers(
+		loader.NewFileLoaderAtCwd(filesys.MakeFsOnDisk()),
+		depProvider.GetFieldValidator(), rmF, types.DisabledPluginConfig())
+	if err = sym.(resmap.Configurable).Config(h, []byte(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      replicas: 3
+`)); err != nil {
+		t.Fatal(err)
+	}
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+`
+	m, err := rmF.NewResMapFromBytes([]byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = sym.(interface {
+		TransformContext(context.Context, resmap.ResMap) error
+	}).TransformContext(ctx, m)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(err.Error(), "transform aborted before chart glance") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	th.AssertActualEqualsExpected(m, input)
+}
+
+func TestEmptyAsDefault(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+emptyAsDefault: %t
+global:
+  empty: ""
+  unset: ~
+  set: custom
+charts:
+  - name: glance
+    override:
+      empty: $(empty:-default)
+      unset: $(unset:-default)
+      set: $(set:-default)
+      undefined: $(undefined:-default)
+      emptyWithoutDefault: $(empty)
+`
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+`
+	for emptyAsDefault, empty := range map[bool]string{false: `""`, true: "default"} {
+		rm := th.LoadAndRunTransformer(fmt.Sprintf(config, emptyAsDefault), input)
+		th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    empty: `+empty+`
+    emptyWithoutDefault: ""
+    set: custom
+    undefined: default
+    unset: default
+`)
+	}
+}
+
+func TestIntervalAndRetries(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  interval: 1m
+  retries: 5
+charts:
+  - name: glance
+    interval: $(interval)
+    retries: $(retries)
+    override:
+      replicas: 3
+  - name: keystone
+    interval: 10m
+    retries: 0
+`, `
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  interval: 5m
+  chart:
+    spec:
+      chart: glance
+  install:
+    createNamespace: true
+    remediation:
+      retries: 3
+---
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    spec:
+      chart: keystone
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    spec:
+      chart: glance
+  install:
+    createNamespace: true
+    remediation:
+      retries: 5
+  interval: 1m
+  values:
+    replicas: 3
+---
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: keystone
+spec:
+  chart:
+    spec:
+      chart: keystone
+  install:
+    remediation:
+      retries: 0
+  interval: 10m
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    retries: many
+`, `
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    spec:
+      chart: glance
+`)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "invalid retries of chart glance") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestConfigMapConfig(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	// the plugin is run directly, since kustomize looks up the plugin by kind of the config
+	p, err := plugin.Open("HelmValuesTransformer.so")
+	if err != nil {
+		t.Fatalf("can not open plugin: %v", err)
+	}
+	sym, err := p.Lookup("KustomizePlugin")
+	if err != nil {
+		t.Fatalf("can not find KustomizePlugin: %v", err)
+	}
+	depProvider := provider.NewDefaultDepProvider()
+	rmF := resmap.NewFactory(depProvider.GetResourceFactory())
+	h := resmap.NewPluginHelpers(
+		loader.NewFileLoaderAtCwd(filesys.MakeFsOnDisk()),
+		depProvider.GetFieldValidator(), rmF, types.DisabledPluginConfig())
+	if err = sym.(resmap.Configurable).Config(h, []byte(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: helm-values-transformer
+data:
+  config: |
+    apiVersion: openinfradev.github.com/v1
+    kind: HelmValuesTransformer
+    metadata:
+      name: site
+    strictConfig: true
+    global:
+      replicas: 3
+    charts:
+      - name: glance
+        override:
+          replicas: $(replicas)
+`)); err != nil {
+		t.Fatal(err)
+	}
+	m, err := rmF.NewResMapFromBytes([]byte(`
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sym.(resmap.Transformer).Transform(m); err != nil {
+		t.Fatal(err)
+	}
+	th.AssertActualEqualsExpected(m, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 3
+`)
+
+	err = sym.(resmap.Configurable).Config(h, []byte(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: helm-values-transformer
+data:
+  charts: glance
+`))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "ConfigMap has no data.config") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRegexReplaceFunc(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  tag: v2.3.1
+  host: api.prod.example.com
+charts:
+  - name: glance
+    override:
+      major: $(tag|regexReplace:^v([0-9]+).*:$1)
+      majorInt: $(tag|regexReplace:^v([0-9]+).*:$1|int)
+      image: glance:$(tag|regexReplace:^v:)-$(host|regexReplace:^([a-z]+)\..*$:${1}x)
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    image: glance:2.3.1-apix
+    major: "2"
+    majorInt: 2
+`)
+
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  tag: v2.3.1
+charts:
+  - name: glance
+    override:
+      major: $(tag|regexReplace:^v[0-9:$1)
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+`)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "invalid pattern of regexReplace") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// buildKRMFunction builds the transformer as a KRM function, whose main is not reached by the plugin
+func buildKRMFunction(t *testing.T) string {
+	t.Helper()
+	bin := filepath.Join(t.TempDir(), "helm-values-transformer")
+	if out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("can not build KRM function: %v\n%s", err, out)
+	}
+	return bin
+}
+
+// runKRMFunction runs bin with stdin and args, and returns stdout, or stderr as the error
+func runKRMFunction(bin, stdin string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(bin, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return stdout.String(), fmt.Errorf("%v: %s", err, stderr.String())
+	}
+	return stdout.String(), nil
+}
+
+func TestKRMFunction(t *testing.T) {
+	bin := buildKRMFunction(t)
+
+	out, err := runKRMFunction(bin, `
+apiVersion: config.kubernetes.io/v1
+kind: ResourceList
+functionConfig:
+  apiVersion: openinfradev.github.com/v1
+  kind: HelmValuesTransformer
+  metadata:
+    name: site
+  charts:
+    - name: glance
+      override:
+        replicas: 3
+items:
+  - apiVersion: helm.fluxcd.io/v1
+    kind: HelmRelease
+    metadata:
+      name: glance
+    spec:
+      chart:
+        version: 1.0.0
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "replicas: 3") {
+		t.Fatalf("unexpected output: %s", out)
+	}
+
+	_, err = runKRMFunction(bin, `
+apiVersion: config.kubernetes.io/v1
+kind: ResourceList
+items:
+  - apiVersion: helm.fluxcd.io/v1
+    kind: HelmRelease
+    metadata:
+      name: glance
+    spec:
+      chart:
+        version: 1.0.0
+`)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "functionConfig is required") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestAllowEmptyCharts(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    replicas: 1
+`
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+`, input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "helmValues is not expected to be nil") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+allowEmpty: true
+`, input)
+	th.AssertActualEqualsExpected(rm, input)
+}
+
+func TestValidateConfigMapConfig(t *testing.T) {
+	bin := buildKRMFunction(t)
+
+	path := filepath.Join(t.TempDir(), "helm-values-transformer.yaml")
+	if err := os.WriteFile(path, []byte(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: helm-values-transformer
+data:
+  config: |
+    apiVersion: openinfradev.github.com/v1
+    kind: HelmValuesTransformer
+    metadata:
+      name: site
+    charts:
+      - name: glance
+        override:
+          replicas: $(undefined)
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := runKRMFunction(bin, "", "validate", path)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "Can not found global variable named $(undefined)") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestShellArithmeticPassThrough(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  count: 2
+  tag: v2.3.1
+charts:
+  - name: glance
+    override:
+      command: echo $((1+2))
+      loop: echo $(( $(count) * (3+4) ))
+      major: $((1+2)) $(tag|regexReplace:^v([0-9]+).*:$1)
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    command: echo $((1+2))
+    loop: echo $(( 2 * (3+4) ))
+    major: $((1+2)) 2
+`)
+}
+
+func TestEscapedVarInWholeValue(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  env: prod
+charts:
+  - name: glance
+    override:
+      command: $(cmd:-$$(date))
+      defined: $(env:-$$(date))
+      nested: $(cmd:-$(env)-$$(date))
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    command: $(date)
+    defined: prod
+    nested: prod-$(date)
+`)
+
+	// a HelmRelease which can not be written as yaml is an error, not dropped
+	os.Setenv("UNWRITABLE_GLOBAL", "\ufffe")
+	defer os.Unsetenv("UNWRITABLE_GLOBAL")
+	err := th.ErrorFromLoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+allowEnvGlobals: true
+charts:
+  - name: glance
+    override:
+      command: $(UNWRITABLE_GLOBAL)
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+`)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "can not write HelmRelease of chart glance") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateCommand(t *testing.T) {
+	bin := buildKRMFunction(t)
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"globals.yaml": `
+replicas: 3
+`,
+		"valid.yaml": `
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+globalsFrom:
+  - globals.yaml
+charts:
+  - name: glance
+    override:
+      replicas: $(replicas)
+`,
+		"invalid.yaml": `
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+charts:
+  - name: glance
+    override:
+      replicas: $(undefined)
+`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the files referred in a config are loaded from the directory of it
+	valid := filepath.Join(dir, "valid.yaml")
+	out, err := runKRMFunction(bin, "", "validate", valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != valid+": valid\n" {
+		t.Fatalf("unexpected output: %s", out)
+	}
+
+	invalid := filepath.Join(dir, "invalid.yaml")
+	_, err = runKRMFunction(bin, "", "validate", valid, invalid)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), invalid+": Can not found global variable named $(undefined)") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = runKRMFunction(bin, "", "validate")
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !strings.Contains(err.Error(), "usage: helm-values-transformer validate <config>...") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestNestedGlobalVarDefault(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		BuildGoPlugin("openinfradev.github.com", "v1", "HelmValuesTransformer")
+	defer th.Reset()
+
+	rm := th.LoadAndRunTransformer(`
+apiVersion: openinfradev.github.com/v1
+kind: HelmValuesTransformer
+metadata:
+  name: site
+global:
+  b: x
+  a: defined
+  env: prod
+  host_prod: prod.example.com
+charts:
+  - name: glance
+    override:
+      undefinedOuter: $(undefined:-$(b))
+      definedOuter: $(a:-$(b))
+      nestedName: $(host_$(env))
+      url: http://$(undefined:-$(host_$(env))):80
+      unterminated: $(a $(b)
+`, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: glance
+spec:
+  chart:
+    version: 1.0.0
+  values:
+    definedOuter: defined
+    nestedName: prod.example.com
+    undefinedOuter: x
+    unterminated: $(a x
+    url: http://prod.example.com:80
+`)
+}
@@ -0,0 +1,110 @@
+// Copyright 2019 The Kubernetes Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/kustomize/api/ifc"
+	"sigs.k8s.io/kustomize/api/loader"
+	"sigs.k8s.io/kustomize/api/provider"
+	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
+	"sigs.k8s.io/yaml"
+)
+
+// main runs the transformer as a KRM function, which reads a ResourceList from stdin
+// and writes the transformed one to stdout. kustomize never calls it when it loads
+// the transformer as a Go plugin.
+// With the validate command, i.e. "validate site.yaml", it validates the config files instead.
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		if err := validateConfigs(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := framework.Execute(framework.ResourceListProcessorFunc(processResourceList), nil); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// processResourceList transforms the items of rl with functionConfig of rl as the config.
+// The files referred in the config, i.e. globalsFrom and valuesSchema, are loaded from the working directory.
+func processResourceList(rl *framework.ResourceList) error {
+	h := newPluginHelpers(loader.NewFileLoaderAtCwd(filesys.MakeFsOnDisk()))
+	rmF := h.ResmapFactory()
+
+	if rl.FunctionConfig == nil {
+		return errors.New("functionConfig is required")
+	}
+	config, err := rl.FunctionConfig.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	p := &plugin{}
+	if err = p.Config(h, config); err != nil {
+		return err
+	}
+	m, err := rmF.NewResMapFromRNodeSlice(rl.Items)
+	if err != nil {
+		return err
+	}
+	if err = p.Transform(m); err != nil {
+		return err
+	}
+	rl.Items = m.ToRNodeSlice()
+	return nil
+}
+
+// validateConfigs validates the transformer config files with validateOnly, i.e. in a pre-commit hook.
+// The files referred in a config are loaded from the directory of it.
+func validateConfigs(paths []string) error {
+	if len(paths) == 0 {
+		return fmt.Errorf("usage: %s validate <config>...", filepath.Base(os.Args[0]))
+	}
+	fSys := filesys.MakeFsOnDisk()
+	for _, path := range paths {
+		c, err := fSys.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		// the config is unwrapped from a ConfigMap first, or validateOnly next to data would be dropped
+		if c, err = unwrapConfigMap(normalizeText(c)); err != nil {
+			return fmt.Errorf("%s: invalid config: %v", path, err)
+		}
+		config := map[string]interface{}{}
+		if err = yaml.Unmarshal(c, &config); err != nil {
+			return fmt.Errorf("%s: invalid config: %v", path, err)
+		}
+		config["validateOnly"] = true
+		if c, err = yaml.Marshal(config); err != nil {
+			return err
+		}
+		ldr, err := loader.NewLoader(loader.RestrictionNone, filepath.Dir(path), fSys)
+		if err != nil {
+			return err
+		}
+		if err = (&plugin{}).Config(newPluginHelpers(ldr), c); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		fmt.Printf("%s: valid\n", path)
+	}
+	return nil
+}
+
+// newPluginHelpers returns the helpers of the plugin loading the files with ldr
+func newPluginHelpers(ldr ifc.Loader) *resmap.PluginHelpers {
+	depProvider := provider.NewDefaultDepProvider()
+	return resmap.NewPluginHelpers(
+		ldr, depProvider.GetFieldValidator(),
+		resmap.NewFactory(depProvider.GetResourceFactory()), types.DisabledPluginConfig())
+}